@@ -0,0 +1,32 @@
+// Package atomicfile replaces files so that readers, including other zat processes,
+// see either the old or the new content, never a partial write.
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile replaces the file at path with b. The file is readable and writable only by its owner.
+func WriteFile(path string, b []byte) error {
+	// the temporary file must be on the same filesystem for the rename to be atomic
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	slackapi "github.com/slack-go/slack"
+	"go.elastic.co/apm"
+	"google.golang.org/api/drive/v3"
+
+	"github.com/graphaelli/zat/google"
+	"github.com/graphaelli/zat/zoom"
+	"github.com/graphaelli/zat/zoom/chatlog"
+	"github.com/graphaelli/zat/zoom/vtt"
+)
+
+const (
+	chatDoc  = "doc"
+	chatHTML = "html"
+)
+
+// isChat reports whether f is the in-meeting chat log
+func isChat(f zoom.RecordingFile) bool {
+	return strings.ToLower(f.FileType) == "chat"
+}
+
+// chatFileName constructs the name of a rendered chat log from the archived chat log name
+func chatFileName(name, format string) string {
+	base := strings.TrimSuffix(name, ".chat.log")
+	if format == chatDoc {
+		// google docs don't have an extension
+		return base + " chat"
+	}
+	return base + ".chat." + format
+}
+
+// chatOffset is the start of the recording relative to the start of the meeting
+func chatOffset(meeting zoom.Meeting, f zoom.RecordingFile) time.Duration {
+	start, err := time.Parse(time.RFC3339, f.RecordingStart)
+	if err != nil || start.Before(meeting.StartTime) {
+		return 0
+	}
+	return start.Sub(meeting.StartTime)
+}
+
+// archiveChat uploads a chat log, unless it has already been archived, along with the requested renderings.
+// Links shared in the chat are returned.
+func (z *Config) archiveChat(ctx context.Context, gdrive *google.Drive, folder *drive.File, meeting zoom.Meeting,
+	f zoom.RecordingFile, name string, body io.Reader, uploadOriginal bool, formats []string, action Directive) ([]chatlog.Link, error) {
+	span, ctx := apm.StartSpan(ctx, "archiveChat", "app")
+	defer span.End()
+
+	original, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("while downloading chat %s: %w", name, err)
+	}
+	if uploadOriginal {
+		if _, err := uploadBytes(ctx, gdrive, &drive.File{
+			Name:                         name,
+			Parents:                      []string{folder.Id},
+			CopyRequiresWriterPermission: action.CopyRequiresWriterPermission,
+			AppProperties:                fileProperties(meeting, f, ""),
+		}, original, ""); err != nil {
+			return nil, fmt.Errorf("while uploading chat %s: %w", name, err)
+		}
+		z.logger.Printf("uploaded %q to %s", name, folder.Name)
+	}
+
+	// renderings are supplementary, the original is archived even when they fail, they are retried on later runs
+	messages, err := chatlog.Parse(bytes.NewReader(original))
+	if err != nil {
+		z.logger.Printf("failed to parse chat %s: %s", name, err)
+		apm.CaptureError(ctx, err).Send()
+		return nil, nil
+	}
+	if len(formats) > 0 {
+		var rendered bytes.Buffer
+		title := fmt.Sprintf("%s %s chat", meeting.Topic, meeting.StartTime.Format("2006-01-02 15:04"))
+		if err := chatlog.RenderHTML(&rendered, title, chatOffset(meeting, f), messages); err != nil {
+			z.logger.Printf("failed to render chat %s: %s", name, err)
+			apm.CaptureError(ctx, err).Send()
+			formats = nil
+		}
+		for _, format := range formats {
+			file := &drive.File{
+				Name:                         chatFileName(name, format),
+				Parents:                      []string{folder.Id},
+				CopyRequiresWriterPermission: action.CopyRequiresWriterPermission,
+				AppProperties:                fileProperties(meeting, f, format),
+			}
+			if format == chatDoc {
+				// drive converts html uploads to a google doc
+				file.MimeType = google.MimeTypeDocument
+			}
+			if _, err := uploadBytes(ctx, gdrive, file, rendered.Bytes(), "text/html"); err != nil {
+				z.logger.Printf("failed to upload chat %s: %s", file.Name, err)
+				apm.CaptureError(ctx, err).Send()
+				continue
+			}
+			z.logger.Printf("uploaded %q to %s", file.Name, folder.Name)
+		}
+	}
+
+	links := chatlog.Links(messages)
+	offset := chatOffset(meeting, f)
+	for i := range links {
+		links[i].Message.Offset += offset
+	}
+	return links, nil
+}
+
+// chatLinksMessage summarizes links shared in chat for slack
+func chatLinksMessage(links []chatlog.Link) string {
+	var b strings.Builder
+	b.WriteString("Links shared in chat:")
+	for _, l := range links {
+		fmt.Fprintf(&b, "\n• %s (%s, %s)", l.URL, l.Message.From, vtt.FormatOffset(l.Message.Offset))
+	}
+	return b.String()
+}
+
+// notifyChatLinks replies in the notification thread with the links shared in chat
+func (z *Config) notifyChatLinks(ctx context.Context, channel, threadTS string, links []chatlog.Link) {
+	if len(links) == 0 {
+		return
+	}
+	if _, _, err := z.slackClient.PostMessageContext(ctx, channel,
+		slackapi.MsgOptionText(chatLinksMessage(links), true),
+		slackapi.MsgOptionTS(threadTS),
+	); err != nil {
+		z.logger.Printf("failed to post chat links to slack %q: %s", channel, err)
+		apm.CaptureError(ctx, err).Send()
+	}
+}
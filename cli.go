@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/graphaelli/zat/cmd"
+)
+
+// errUsage is returned when a command is invoked incorrectly, after printing its usage
+var errUsage = errors.New("invalid usage")
+
+// command is a zat subcommand, or a group of subcommands
+type command struct {
+	name    string
+	args    string
+	summary string
+	// setup registers the command's flags, returning the function that runs it with the remaining arguments.
+	// It must not do anything else, it is also used to list flags for shell completion.
+	setup       func(fs *flag.FlagSet, env *cliEnv) func(args []string) error
+	subcommands []*command
+}
+
+// cliEnv is shared by all commands
+type cliEnv struct {
+	globals *cmd.Globals
+	logger  *log.Logger
+	stdin   io.Reader
+	stdout  io.Writer
+	stderr  io.Writer
+}
+
+func commands() []*command {
+	return []*command{
+		{name: "serve", summary: "start the web interface, archiving once at startup", setup: setupServe},
+		{name: "archive", summary: "archive recent recordings once", setup: setupArchive},
+		{name: "migrate", summary: "tag folders and files archived by earlier versions, matching them by name", setup: setupMigrate},
+		{name: "validate", summary: "check the configuration in the config directory", setup: setupValidate},
+		{name: "search", args: "<query ...>", summary: "search the transcripts and chat of archived recordings", setup: setupSearch},
+		{name: "login", args: "google|zoom", summary: "log in from a terminal, saving credentials to the config directory", setup: setupLogin},
+		{name: "zoom", summary: "zoom utilities", subcommands: []*command{
+			{name: "list", summary: "list recent recordings and their meeting IDs", setup: setupZoomList},
+		}},
+		{name: "drive", summary: "google drive utilities", subcommands: []*command{
+			{name: "find", summary: "find folders and their IDs", setup: setupDriveFind},
+			{name: "upload", args: "<src dir> <dst folder id>", summary: "upload a directory to a new folder", setup: setupDriveUpload},
+		}},
+		{name: "slack", summary: "slack utilities", subcommands: []*command{
+			{name: "channels", summary: "list channels and their IDs", setup: setupSlackChannels},
+			{name: "chat", args: "<channel> [text ...]", summary: "send a message, to verify permissions", setup: setupSlackChat},
+		}},
+		{name: "creds", summary: "credential utilities", subcommands: []*command{
+			{name: "encrypt", summary: "encrypt stored credentials, or generate a key", setup: setupCredsEncrypt},
+		}},
+		{name: "completion", args: "bash|zsh", summary: "print a shell completion script", setup: setupCompletion},
+	}
+}
+
+// runCLI runs the command named by args, returning the process exit code
+func runCLI(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	env := &cliEnv{
+		globals: cmd.NewGlobals(),
+		logger:  log.New(stderr, "", cmd.LogFmt),
+		stdin:   stdin,
+		stdout:  stdout,
+		stderr:  stderr,
+	}
+	root := &command{name: "zat", subcommands: commands()}
+
+	var err error
+	if legacy(args) {
+		// zat predates subcommands, flags alone start the server as before
+		err = env.dispatch(findCommand(root, "serve"), []string{"zat"}, args)
+	} else {
+		top := flag.NewFlagSet("zat", flag.ContinueOnError)
+		top.SetOutput(ioutil.Discard)
+		env.globals.Register(top)
+		if err = top.Parse(args); err == nil {
+			err = env.dispatch(root, []string{"zat"}, top.Args())
+		} else if err == flag.ErrHelp {
+			env.usage(root, []string{"zat"})
+			err = nil
+		}
+	}
+	switch {
+	case err == nil:
+		return 0
+	case err == errUsage:
+		return 2
+	default:
+		env.logger.Print(err)
+		return 1
+	}
+}
+
+// legacy reports whether args are flags for the server, rather than global flags followed by a subcommand
+func legacy(args []string) bool {
+	if len(args) == 0 {
+		return true
+	}
+	if !strings.HasPrefix(args[0], "-") {
+		return false
+	}
+	top := flag.NewFlagSet("zat", flag.ContinueOnError)
+	top.SetOutput(ioutil.Discard)
+	cmd.NewGlobals().Register(top)
+	err := top.Parse(args)
+	return (err != nil && err != flag.ErrHelp) || (err == nil && top.NArg() == 0)
+}
+
+func findCommand(c *command, name string) *command {
+	for _, sub := range c.subcommands {
+		if sub.name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+// dispatch runs c, or the subcommand of c named by the first argument
+func (env *cliEnv) dispatch(c *command, path []string, args []string) error {
+	if len(c.subcommands) > 0 {
+		if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+			if len(args) > 1 && args[0] == "help" {
+				// help for a subcommand
+				return env.dispatch(c, path, append(args[1:], "-h"))
+			}
+			env.usage(c, path)
+			if len(args) == 0 {
+				return errUsage
+			}
+			return nil
+		}
+		sub := findCommand(c, args[0])
+		if sub == nil {
+			fmt.Fprintf(env.stderr, "unknown command %q\n\n", strings.Join(append(path, args[0]), " "))
+			env.usage(c, path)
+			return errUsage
+		}
+		return env.dispatch(sub, append(path, sub.name), args[1:])
+	}
+
+	fs := flag.NewFlagSet(strings.Join(path, " "), flag.ContinueOnError)
+	fs.SetOutput(env.stderr)
+	env.globals.Register(fs)
+	run := c.setup(fs, env)
+	fs.Usage = func() {
+		fmt.Fprintf(env.stderr, "usage: %s [flags] %s\n\n%s\n\nflags:\n", strings.Join(path, " "), c.args, c.summary)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return errUsage
+	}
+	if env.globals.Output != cmd.OutputTable && env.globals.Output != cmd.OutputJSON {
+		fmt.Fprintf(env.stderr, "invalid -output %q, use %s or %s\n", env.globals.Output, cmd.OutputTable, cmd.OutputJSON)
+		return errUsage
+	}
+	return run(fs.Args())
+}
+
+// leaves lists the runnable commands below c, with their full names
+func leaves(c *command, path []string) map[string]*command {
+	found := make(map[string]*command)
+	for _, sub := range c.subcommands {
+		name := strings.TrimSpace(strings.Join(append(path, sub.name), " "))
+		if len(sub.subcommands) == 0 {
+			found[name] = sub
+			continue
+		}
+		for n, leaf := range leaves(sub, append(path, sub.name)) {
+			found[n] = leaf
+		}
+	}
+	return found
+}
+
+func (env *cliEnv) usage(c *command, path []string) {
+	fmt.Fprintf(env.stderr, "usage: %s [global flags] <command> [flags] [args]\n\ncommands:\n", strings.Join(path, " "))
+	all := leaves(c, nil)
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(env.stderr, "  %-18s %s\n", name, all[name].summary)
+	}
+	fmt.Fprintf(env.stderr, "\nglobal flags:\n")
+	fs := flag.NewFlagSet(path[0], flag.ContinueOnError)
+	fs.SetOutput(env.stderr)
+	cmd.NewGlobals().Register(fs)
+	fs.PrintDefaults()
+	fmt.Fprintf(env.stderr, "\nRun \"%s <command> -h\" for the flags of a command.\n", strings.Join(path, " "))
+}
@@ -3,6 +3,14 @@ package cmd
 import (
 	"flag"
 	"log"
+	"path"
+
+	slackapi "github.com/slack-go/slack"
+
+	"github.com/graphaelli/zat/google"
+	"github.com/graphaelli/zat/oauth"
+	"github.com/graphaelli/zat/slack"
+	"github.com/graphaelli/zat/zoom"
 )
 
 const (
@@ -15,13 +23,84 @@ const (
 	// zoom API credentials - zoom.Config{}, read only ok
 	// optional slack API credentials, read only ok
 	SlackConfigPath = "slack.config.json"
-	ZoomConfigPath = "zoom.config.json"
+	ZoomConfigPath  = "zoom.config.json"
 	// zoom OAuth persistence - oauth2.Token{}, read/write
 	ZoomCredsPath = "zoom.creds.json"
 
 	ZatConfigPath = "zat.yml"
+	// optional web interface authentication - auth.yml, read only ok
+	AuthConfigPath = "auth.yml"
+	// held while archiving, read/write
+	LockPath = "zat.lock"
+	// recordings zoom was still processing, to recheck later, read/write
+	PendingPath = "zat.pending.json"
+	// folder IDs google destination paths resolved to, read/write
+	FoldersPath = "zat.folders.json"
+	// search index of archived transcripts and chat, read/write
+	IndexPath = "zat.index.json"
+)
+
+const (
+	OutputTable = "table"
+	OutputJSON  = "json"
 )
 
-func FlagConfigDir() *string {
-	return flag.String("config-dir", ".", "base directory for configuration files")
+// Globals are the flags shared by all zat commands
+type Globals struct {
+	ConfigDir    string
+	CredsKeyFile string
+	Output       string
+}
+
+func NewGlobals() *Globals {
+	return &Globals{ConfigDir: ".", Output: OutputTable}
+}
+
+// Register adds the global flags to fs, defaulting to their current values
+// so they can be given both before and after a subcommand.
+func (g *Globals) Register(fs *flag.FlagSet) {
+	fs.StringVar(&g.ConfigDir, "config-dir", g.ConfigDir, "base directory for configuration files")
+	fs.StringVar(&g.CredsKeyFile, "creds-key-file", g.CredsKeyFile,
+		"file holding the base64 encoded key for encrypting credentials, defaults to $"+oauth.KeyEnv+", plaintext when neither is set")
+	fs.StringVar(&g.Output, "output", g.Output, "output format: "+OutputTable+" or "+OutputJSON)
+}
+
+// Path locates a file in the config directory
+func (g *Globals) Path(name string) string {
+	return path.Join(g.ConfigDir, name)
+}
+
+// GoogleClient creates a google client from the config directory, persisting credentials there
+func (g *Globals) GoogleClient(logger *log.Logger, options ...google.ClientOption) (*google.Client, error) {
+	store, err := CredentialsStore(g.Path(GoogleCredsPath), g.CredsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	options = append([]google.ClientOption{google.NewCredentialsManagerFromStore(store).ClientOption}, options...)
+	return google.NewClientFromFile(logger, g.Path(GoogleConfigPath), options...)
+}
+
+// ZoomClient creates a zoom client from the config directory, persisting credentials there
+func (g *Globals) ZoomClient(logger *log.Logger, options ...zoom.ClientOption) (*zoom.Client, error) {
+	store, err := CredentialsStore(g.Path(ZoomCredsPath), g.CredsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	options = append([]zoom.ClientOption{zoom.NewCredentialsManagerFromStore(store).ClientOption}, options...)
+	return zoom.NewClientFromFile(logger, g.Path(ZoomConfigPath), options...)
+}
+
+// SlackClient creates a slack client from the environment or config directory, nil when not configured
+func (g *Globals) SlackClient(logger *log.Logger, options ...slackapi.Option) *slackapi.Client {
+	client, _ := slack.NewClientFromEnvOrFile(logger, g.Path(SlackConfigPath), options...)
+	return client
+}
+
+// CredentialsStore persists credentials at path, encrypted when a key is configured
+func CredentialsStore(path, keyFile string) (oauth.Store, error) {
+	key, err := oauth.LoadKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return oauth.NewStore(path, key), nil
 }
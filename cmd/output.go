@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// Print writes records as an aligned table with headers, or as a json array.
+// row formats record i as table cells.
+func Print(w io.Writer, format string, headers []string, records interface{}, count int, row func(i int) []string) error {
+	switch format {
+	case OutputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	case OutputTable, "":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(headers, "\t"))
+		for i := 0; i < count; i++ {
+			fmt.Fprintln(tw, strings.Join(row(i), "\t"))
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format %q, use %s or %s", format, OutputTable, OutputJSON)
+	}
+}
@@ -0,0 +1,745 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	slackapi "github.com/slack-go/slack"
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/module/apmhttp"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+
+	"github.com/graphaelli/zat/cmd"
+	"github.com/graphaelli/zat/google"
+	"github.com/graphaelli/zat/oauth"
+	"github.com/graphaelli/zat/search"
+	"github.com/graphaelli/zat/zoom"
+)
+
+// archiveFlags are shared by the commands that archive recordings
+type archiveFlags struct {
+	params      runParams
+	waitForLock time.Duration
+	driveQPS    float64
+	publicURL   string
+	preRun      string
+	postRun     string
+	ffmpeg      string
+}
+
+func (a *archiveFlags) register(fs *flag.FlagSet) {
+	fs.IntVar(&a.params.minDuration, "min-duration", 5, "minimum meeting duration in minutes to archive")
+	fs.DurationVar(&a.params.since, "since", 168*time.Hour, "archive meetings started within this long")
+	fs.StringVar(&a.params.uploadFilter, "t", "",
+		"comma separated list of file types to archive (mp4, m4a, timeline, transcript, chat, cc, csv), see: "+
+			"https://marketplace.zoom.us/docs/api-reference/zoom-api/cloud-recording/recordingget")
+	fs.DurationVar(&a.waitForLock, "wait-for-lock", 0, "how long to wait for another zat process to finish archiving, skip the run when 0")
+	fs.Float64Var(&a.driveQPS, "drive-qps", google.DefaultDriveQPS, "maximum google drive requests per second, 0 for no limit")
+	fs.StringVar(&a.publicURL, "public-url", "", "URL zat is reached at, eg https://zat.example.com, for podcast feeds written to drive")
+	fs.StringVar(&a.preRun, "pre-run", "", "shell command to run before archiving, archiving is skipped when it fails")
+	fs.StringVar(&a.ffmpeg, "ffmpeg", "ffmpeg", "ffmpeg binary for directives that transcode or trim recordings, trimming also runs the ffprobe beside it")
+	fs.StringVar(&a.postRun, "post-run", "", "shell command to run after archiving, with the meetings archived as json on stdin")
+}
+
+// clients are the API clients configured in the config directory
+type clients struct {
+	google *google.Client
+	zoom   *zoom.Client
+	// slack is nil when not configured
+	slack *slackapi.Client
+}
+
+func (env *cliEnv) clients(driveQPS float64) (*clients, error) {
+	googleClient, err := env.globals.GoogleClient(env.logger,
+		google.DriveOption(driveQPS, google.DefaultMaxRetries, google.DefaultRetryBackoff))
+	if err != nil {
+		return nil, fmt.Errorf("while creating google client: %w", err)
+	}
+	zoomClient, err := env.globals.ZoomClient(env.logger)
+	if err != nil {
+		return nil, fmt.Errorf("while creating zoom client: %w", err)
+	}
+	return &clients{
+		google: googleClient,
+		zoom:   zoomClient,
+		slack:  env.globals.SlackClient(env.logger, slackapi.OptionHTTPClient(http.DefaultClient)),
+	}, nil
+}
+
+// refreshInBackground refreshes tokens ahead of expiry rather than when next needed, until ctx is done
+func (c *clients) refreshInBackground(ctx context.Context) {
+	captureRefreshError := func(err error) {
+		apm.CaptureError(ctx, err).Send()
+	}
+	c.google.RefreshInBackground(ctx, captureRefreshError)
+	c.zoom.RefreshInBackground(ctx, captureRefreshError)
+}
+
+// config loads the archive directives from the config directory
+func (env *cliEnv) config(c *clients, a archiveFlags) (*Config, error) {
+	zat, err := NewConfigFromFile(env.logger, env.globals.Path(cmd.ZatConfigPath), c.google, c.zoom, c.slack)
+	if err != nil {
+		return nil, fmt.Errorf("while loading %s: %w", cmd.ZatConfigPath, err)
+	}
+	zat.lockPath = env.globals.Path(cmd.LockPath)
+	zat.lockWait = a.waitForLock
+	zat.pendingPath = env.globals.Path(cmd.PendingPath)
+	zat.foldersPath = env.globals.Path(cmd.FoldersPath)
+	zat.publicURL = a.publicURL
+	zat.preRun = a.preRun
+	zat.postRun = a.postRun
+	zat.ffmpeg = a.ffmpeg
+	zat.indexPath = env.globals.Path(cmd.IndexPath)
+	zat.index = search.New(zat.indexPath)
+	return zat, nil
+}
+
+// requireConfig is config for commands that can't do anything without directives
+func (env *cliEnv) requireConfig(c *clients, a archiveFlags) (*Config, error) {
+	if _, err := os.Stat(env.globals.Path(cmd.ZatConfigPath)); err != nil {
+		return nil, fmt.Errorf("a config is required: %w", err)
+	}
+	return env.config(c, a)
+}
+
+func setupServe(fs *flag.FlagSet, env *cliEnv) func(args []string) error {
+	var a archiveFlags
+	a.register(fs)
+	addr := fs.String("addr", "localhost:8080", "web server listener address")
+	noServer := fs.Bool("no-server", false, "archive once without starting the web server, same as zat archive")
+	pendingRetry := fs.Duration("pending-retry", 15*time.Minute,
+		"how often the server rechecks recordings zoom is still processing, 0 to only recheck on scheduled runs")
+	return func(args []string) error {
+		if len(args) > 0 {
+			fs.Usage()
+			return errUsage
+		}
+		if *noServer {
+			return env.archive(a)
+		}
+		return env.serve(a, *addr, *pendingRetry)
+	}
+}
+
+func (env *cliEnv) serve(a archiveFlags, addr string, pendingRetry time.Duration) error {
+	c, err := env.clients(a.driveQPS)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.refreshInBackground(ctx)
+
+	zat, err := env.config(c, a)
+	if err != nil {
+		// ok to continue without config, just can't do archival
+		env.logger.Println("failed to load config", err)
+	}
+	auth, err := NewWebAuthFromFile(env.logger, env.globals.Path(cmd.AuthConfigPath), c.google)
+	if err != nil {
+		return fmt.Errorf("failed to load web authentication config: %w", err)
+	}
+	if auth == nil && !strings.HasPrefix(addr, "localhost:") && !strings.HasPrefix(addr, "127.0.0.1:") {
+		env.logger.Printf("warning: %s is not configured, anyone reaching %s can use zat", cmd.AuthConfigPath, addr)
+	}
+
+	server := http.Server{
+		Addr:    addr,
+		Handler: apmhttp.Wrap(NewMux(zat, a.params, auth)),
+	}
+	if zat != nil {
+		if pendingRetry > 0 {
+			go retryPending(zat, a.params, pendingRetry)
+		}
+		go doRun(zat, a.params)
+	}
+	env.logger.Printf("starting on http://%s", server.Addr)
+	return server.ListenAndServe()
+}
+
+func setupArchive(fs *flag.FlagSet, env *cliEnv) func(args []string) error {
+	var a archiveFlags
+	a.register(fs)
+	return func(args []string) error {
+		if len(args) > 0 {
+			fs.Usage()
+			return errUsage
+		}
+		return env.archive(a)
+	}
+}
+
+func (env *cliEnv) archive(a archiveFlags) error {
+	c, err := env.clients(a.driveQPS)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.refreshInBackground(ctx)
+
+	zat, err := env.requireConfig(c, a)
+	if err != nil {
+		return err
+	}
+	if !c.google.HasCreds() {
+		return errors.New("no Google creds")
+	}
+	if !c.zoom.HasCreds() {
+		return errors.New("no Zoom creds")
+	}
+	zat.logger.Print("starting archive tool")
+	return zat.Run(a.params)
+}
+
+func setupMigrate(fs *flag.FlagSet, env *cliEnv) func(args []string) error {
+	var a archiveFlags
+	fs.DurationVar(&a.params.since, "since", 168*time.Hour, "migrate meetings started within this long")
+	fs.DurationVar(&a.waitForLock, "wait-for-lock", 0, "how long to wait for another zat process to finish archiving")
+	fs.Float64Var(&a.driveQPS, "drive-qps", google.DefaultDriveQPS, "maximum google drive requests per second, 0 for no limit")
+	return func(args []string) error {
+		if len(args) > 0 {
+			fs.Usage()
+			return errUsage
+		}
+		c, err := env.clients(a.driveQPS)
+		if err != nil {
+			return err
+		}
+		zat, err := env.requireConfig(c, a)
+		if err != nil {
+			return err
+		}
+		return zat.MigrateProperties(context.Background(), a.params.since)
+	}
+}
+
+const (
+	checkOK            = "ok"
+	checkNotConfigured = "not configured"
+	checkFailed        = "failed"
+)
+
+type check struct {
+	File   string `json:"file"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func setupValidate(fs *flag.FlagSet, env *cliEnv) func(args []string) error {
+	return func(args []string) error {
+		if len(args) > 0 {
+			fs.Usage()
+			return errUsage
+		}
+		checks := env.validate()
+		if err := cmd.Print(env.stdout, env.globals.Output, []string{"FILE", "STATUS", "DETAIL"}, checks, len(checks),
+			func(i int) []string { return []string{checks[i].File, checks[i].Status, checks[i].Detail} },
+		); err != nil {
+			return err
+		}
+		failed := 0
+		for _, c := range checks {
+			if c.Status == checkFailed {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+		}
+		return nil
+	}
+}
+
+// validate checks the files in the config directory, refreshing credentials about to expire
+func (env *cliEnv) validate() []check {
+	var checks []check
+	add := func(file string, err error, detail string) {
+		c := check{File: file, Status: checkOK, Detail: detail}
+		if err != nil {
+			c.Status, c.Detail = checkFailed, err.Error()
+		}
+		checks = append(checks, c)
+	}
+	exists := func(file string) bool {
+		_, err := os.Stat(env.globals.Path(file))
+		return err == nil
+	}
+
+	googleClient, err := env.globals.GoogleClient(env.logger)
+	detail := ""
+	if googleClient != nil {
+		if email, subject := googleClient.ServiceAccount(); subject != "" {
+			detail = fmt.Sprintf("service account %s impersonating %s", email, subject)
+		} else if email != "" {
+			detail = "service account " + email
+		}
+	}
+	add(cmd.GoogleConfigPath, err, detail)
+	switch {
+	case googleClient == nil || detail != "":
+		// service accounts need no stored credentials
+	case googleClient.HasCreds():
+		add(cmd.GoogleCredsPath, nil, "")
+	case exists(cmd.GoogleCredsPath):
+		add(cmd.GoogleCredsPath, errors.New("unreadable, check -creds-key-file"), "")
+	default:
+		add(cmd.GoogleCredsPath, errors.New("missing, run zat login or sign in through the web interface"), "")
+	}
+
+	zoomClient, err := env.globals.ZoomClient(env.logger)
+	add(cmd.ZoomConfigPath, err, "")
+	switch {
+	case zoomClient == nil:
+	case zoomClient.HasCreds():
+		add(cmd.ZoomCredsPath, nil, "")
+	case exists(cmd.ZoomCredsPath):
+		add(cmd.ZoomCredsPath, errors.New("unreadable, check -creds-key-file"), "")
+	default:
+		add(cmd.ZoomCredsPath, errors.New("missing, run zat login or sign in through the web interface"), "")
+	}
+
+	if !exists(cmd.ZatConfigPath) {
+		add(cmd.ZatConfigPath, errors.New("missing, nothing will be archived"), "")
+	} else {
+		zat, err := NewConfigFromFile(env.logger, env.globals.Path(cmd.ZatConfigPath), nil, nil, nil)
+		detail = ""
+		if err == nil {
+			detail = fmt.Sprintf("%d directives", len(zat.copies))
+		}
+		add(cmd.ZatConfigPath, err, detail)
+	}
+
+	if env.globals.SlackClient(env.logger) == nil {
+		checks = append(checks, check{File: cmd.SlackConfigPath, Status: checkNotConfigured})
+	} else {
+		add(cmd.SlackConfigPath, nil, "")
+	}
+
+	if !exists(cmd.AuthConfigPath) {
+		checks = append(checks, check{File: cmd.AuthConfigPath, Status: checkNotConfigured, Detail: "anyone reaching the web interface can use it"})
+	} else {
+		_, err := NewWebAuthFromFile(env.logger, env.globals.Path(cmd.AuthConfigPath), googleClient)
+		add(cmd.AuthConfigPath, err, "")
+	}
+	return checks
+}
+
+const (
+	loginLoopback = "loopback"
+	loginPaste    = "paste"
+)
+
+// loginClient is implemented by the google and zoom clients
+type loginClient interface {
+	LoginFlow() (*oauth.Flow, []oauth2.AuthCodeOption)
+	SetCreds(token *oauth2.Token) error
+}
+
+func setupLogin(fs *flag.FlagSet, env *cliEnv) func(args []string) error {
+	method := fs.String("method", loginLoopback, "how to log in: "+loginLoopback+" with a browser on this machine, "+
+		loginPaste+" the redirect URL from a browser anywhere")
+	redirect := fs.String("redirect", "", "loopback redirect URL to listen on, defaults to the configured redirect URL")
+	return func(args []string) error {
+		if len(args) != 1 {
+			fs.Usage()
+			return errUsage
+		}
+		var (
+			client    loginClient
+			credsPath string
+			err       error
+		)
+		switch args[0] {
+		case "google":
+			client, err = env.globals.GoogleClient(env.logger)
+			credsPath = cmd.GoogleCredsPath
+		case "zoom":
+			client, err = env.globals.ZoomClient(env.logger)
+			credsPath = cmd.ZoomCredsPath
+		default:
+			fs.Usage()
+			return errUsage
+		}
+		if err != nil {
+			return fmt.Errorf("while creating %s client: %w", args[0], err)
+		}
+
+		flow, opts := client.LoginFlow()
+		if flow == nil {
+			return google.ErrServiceAccount
+		}
+		prompt := oauth.Prompt{In: env.stdin, Out: env.stderr}
+		ctx := context.Background()
+		var token *oauth2.Token
+		switch *method {
+		case loginLoopback:
+			if *redirect == "" {
+				*redirect = flow.Config.RedirectURL
+				if u, err := url.Parse(*redirect); args[0] == "google" && (err != nil || u.Scheme != "http") {
+					// google desktop clients accept any loopback redirect
+					*redirect = "http://127.0.0.1"
+				}
+			}
+			token, err = flow.LoopbackLogin(ctx, prompt, *redirect, opts...)
+			if errors.Is(err, oauth.ErrNotLoopback) {
+				err = fmt.Errorf("%w, use -method %s or -redirect", err, loginPaste)
+			}
+		case loginPaste:
+			token, err = flow.PasteLogin(ctx, prompt, opts...)
+		default:
+			fs.Usage()
+			return errUsage
+		}
+		if err != nil {
+			return fmt.Errorf("%s login failed: %w", args[0], err)
+		}
+		if err := client.SetCreds(token); err != nil {
+			return fmt.Errorf("while saving %s credentials: %w", args[0], err)
+		}
+		env.logger.Printf("logged in to %s, credentials saved to %s", args[0], env.globals.Path(credsPath))
+		return nil
+	}
+}
+
+func setupZoomList(fs *flag.FlagSet, env *cliEnv) func(args []string) error {
+	since := fs.Duration("since", 168*time.Hour, "list meetings started within this long")
+	return func(args []string) error {
+		if len(args) > 0 {
+			fs.Usage()
+			return errUsage
+		}
+		zoomClient, err := env.globals.ZoomClient(env.logger)
+		if err != nil {
+			return fmt.Errorf("while creating zoom client: %w", err)
+		}
+		meetings := []zoom.Meeting{}
+		nextPageToken := ""
+		for {
+			recordings, err := zoomClient.ListRecordings(context.Background(), time.Now().Add(-1**since), nextPageToken)
+			if err != nil {
+				return fmt.Errorf("failed to list recordings: %w", err)
+			}
+			meetings = append(meetings, recordings.Meetings...)
+			nextPageToken = recordings.NextPageToken
+			if nextPageToken == "" {
+				break
+			}
+		}
+
+		var rows [][]string
+		for _, meeting := range meetings {
+			files := append([]zoom.RecordingFile(nil), meeting.RecordingFiles...)
+			sort.SliceStable(files, func(i, j int) bool { return recordingType(files[i]) < recordingType(files[j]) })
+			for _, f := range files {
+				rows = append(rows, []string{
+					meeting.StartTime.Format("2006-01-02"),
+					fmt.Sprint(meeting.ID),
+					meeting.Topic,
+					recordingType(f),
+					f.Status,
+					zoom.RedactURL(f.DownloadURL),
+				})
+			}
+		}
+		return cmd.Print(env.stdout, env.globals.Output, []string{"START", "MEETING ID", "TOPIC", "RECORDING", "STATUS", "DOWNLOAD URL"},
+			meetings, len(rows), func(i int) []string { return rows[i] })
+	}
+}
+
+// recordingType describes a recording file for listing
+func recordingType(f zoom.RecordingFile) string {
+	if f.RecordingType != "" {
+		return strings.ToLower(f.RecordingType)
+	}
+	return strings.ToLower(f.FileType)
+}
+
+type driveFolder struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+func folderURL(id string) string {
+	return "https://drive.google.com/drive/folders/" + id
+}
+
+func setupDriveFind(fs *flag.FlagSet, env *cliEnv) func(args []string) error {
+	andQuery := fs.String("query", "", "google drive query: https://developers.google.com/drive/api/v3/search-files")
+	maxPages := fs.Int("pages", 4, "maximum number of result pages to list")
+	return func(args []string) error {
+		if len(args) > 0 {
+			fs.Usage()
+			return errUsage
+		}
+		googleClient, err := env.globals.GoogleClient(env.logger)
+		if err != nil {
+			return fmt.Errorf("while creating google client: %w", err)
+		}
+		ctx := context.Background()
+		gdrive, err := googleClient.Drive(ctx)
+		if err != nil {
+			return fmt.Errorf("while creating gdrive client: %w", err)
+		}
+		query := fmt.Sprintf("mimeType='%s'", google.MimeTypeFolder)
+		if *andQuery != "" {
+			query += " and " + *andQuery
+		}
+		folders := []driveFolder{}
+		pageToken := ""
+		for page := 0; page < *maxPages; page++ {
+			files, err := gdrive.ListFiles(ctx, query, pageToken, googleapi.Field("nextPageToken, files(id, name)"))
+			if err != nil {
+				return fmt.Errorf("while finding folders: %w", err)
+			}
+			for _, f := range files.Files {
+				folders = append(folders, driveFolder{ID: f.Id, Name: f.Name, URL: folderURL(f.Id)})
+			}
+			if files.NextPageToken == "" {
+				break
+			}
+			pageToken = files.NextPageToken
+		}
+		return cmd.Print(env.stdout, env.globals.Output, []string{"NAME", "ID", "URL"}, folders, len(folders),
+			func(i int) []string { return []string{folders[i].Name, folders[i].ID, folders[i].URL} })
+	}
+}
+
+func setupDriveUpload(fs *flag.FlagSet, env *cliEnv) func(args []string) error {
+	return func(args []string) error {
+		if len(args) != 2 {
+			fs.Usage()
+			return errUsage
+		}
+		src, dst := args[0], args[1]
+		srcInfo, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		if !srcInfo.IsDir() {
+			return errors.New("only directories supported")
+		}
+		files, err := ioutil.ReadDir(src)
+		if err != nil {
+			return err
+		}
+
+		googleClient, err := env.globals.GoogleClient(env.logger)
+		if err != nil {
+			return fmt.Errorf("while creating google client: %w", err)
+		}
+		ctx := context.Background()
+		gdrive, err := googleClient.Drive(ctx)
+		if err != nil {
+			return fmt.Errorf("while creating gdrive client: %w", err)
+		}
+		parent, err := gdrive.GetFile(ctx, dst)
+		if err != nil {
+			return fmt.Errorf("while finding folder %s: %w", dst, err)
+		}
+		dir, err := gdrive.CreateFile(ctx, &drive.File{
+			Name:     srcInfo.Name(),
+			MimeType: google.MimeTypeFolder,
+			Parents:  []string{parent.Id},
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("while creating folder %s: %w", srcInfo.Name(), err)
+		}
+		env.logger.Printf("created folder %s - %s", dir.Name, folderURL(dir.Id))
+
+		uploaded := []driveFolder{}
+		for _, file := range files {
+			if file.IsDir() {
+				env.logger.Printf("skipping directory %s", file.Name())
+				continue
+			}
+			r, err := os.Open(path.Join(src, file.Name()))
+			if err != nil {
+				return err
+			}
+			up, err := gdrive.CreateFile(ctx, &drive.File{
+				Name:    file.Name(),
+				Parents: []string{dir.Id},
+			}, r)
+			r.Close()
+			if err != nil {
+				return fmt.Errorf("while uploading %s: %w", file.Name(), err)
+			}
+			env.logger.Printf("uploaded %s to %s", up.Name, folderURL(dir.Id))
+			uploaded = append(uploaded, driveFolder{ID: up.Id, Name: up.Name, URL: folderURL(dir.Id)})
+		}
+		return cmd.Print(env.stdout, env.globals.Output, []string{"NAME", "ID", "FOLDER"}, uploaded, len(uploaded),
+			func(i int) []string { return []string{uploaded[i].Name, uploaded[i].ID, uploaded[i].URL} })
+	}
+}
+
+type slackChannel struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// slackClient is the configured slack client, an error when slack is not configured
+func (env *cliEnv) slackClient() (*slackapi.Client, error) {
+	api := env.globals.SlackClient(env.logger)
+	if api == nil {
+		return nil, fmt.Errorf("slack is not configured, set $SLACK_TOKEN or create %s", env.globals.Path(cmd.SlackConfigPath))
+	}
+	return api, nil
+}
+
+func setupSlackChannels(fs *flag.FlagSet, env *cliEnv) func(args []string) error {
+	return func(args []string) error {
+		if len(args) > 0 {
+			fs.Usage()
+			return errUsage
+		}
+		api, err := env.slackClient()
+		if err != nil {
+			return err
+		}
+		found := []slackChannel{}
+		next := ""
+		for i := 0; i == 0 || next != ""; i++ {
+			channels, nextCursor, err := api.GetConversations(&slackapi.GetConversationsParameters{
+				Cursor:          next,
+				ExcludeArchived: "true",
+				Limit:           100,
+			})
+			if err != nil {
+				return fmt.Errorf("while listing channels: %w", err)
+			}
+			for _, channel := range channels {
+				found = append(found, slackChannel{ID: channel.ID, Name: channel.NameNormalized})
+			}
+			next = nextCursor
+		}
+		return cmd.Print(env.stdout, env.globals.Output, []string{"ID", "NAME"}, found, len(found),
+			func(i int) []string { return []string{found[i].ID, found[i].Name} })
+	}
+}
+
+type slackMessage struct {
+	Channel   string `json:"channel"`
+	Timestamp string `json:"ts"`
+	Text      string `json:"text"`
+}
+
+func setupSlackChat(fs *flag.FlagSet, env *cliEnv) func(args []string) error {
+	noEscape := fs.Bool("n", false, "don't escape message text")
+	return func(args []string) error {
+		if len(args) < 1 {
+			fs.Usage()
+			return errUsage
+		}
+		text := "Hello, zat"
+		if len(args) > 1 {
+			text = strings.Join(args[1:], " ")
+		}
+		api, err := env.slackClient()
+		if err != nil {
+			return err
+		}
+		channel, ts, text, err := api.SendMessage(args[0], slackapi.MsgOptionText(text, !*noEscape))
+		if err != nil {
+			return fmt.Errorf("while sending message to %s: %w", args[0], err)
+		}
+		sent := []slackMessage{{Channel: channel, Timestamp: ts, Text: text}}
+		return cmd.Print(env.stdout, env.globals.Output, []string{"CHANNEL", "TS", "TEXT"}, sent, len(sent),
+			func(i int) []string { return []string{sent[i].Channel, sent[i].Timestamp, sent[i].Text} })
+	}
+}
+
+func setupSearch(fs *flag.FlagSet, env *cliEnv) func(args []string) error {
+	limit := fs.Int("n", 20, "maximum number of matches, 0 for all")
+	return func(args []string) error {
+		if len(args) == 0 {
+			fs.Usage()
+			return errUsage
+		}
+		index, err := search.Open(env.globals.Path(cmd.IndexPath))
+		if err != nil {
+			return fmt.Errorf("while loading %s: %w", cmd.IndexPath, err)
+		}
+		results := searchResults(index.Search(strings.Join(args, " "), *limit))
+		return cmd.Print(env.stdout, env.globals.Output, []string{"START", "TOPIC", "AT", "SPEAKER", "MATCH", "LINK"}, results, len(results),
+			func(i int) []string {
+				r := results[i]
+				return []string{r.Start.Format("2006-01-02 15:04"), r.Topic, r.At, r.Speaker, r.Snippet, r.Link}
+			})
+	}
+}
+
+func setupCredsEncrypt(fs *flag.FlagSet, env *cliEnv) func(args []string) error {
+	decrypt := fs.Bool("decrypt", false, "decrypt credentials back to plaintext")
+	generate := fs.Bool("generate-key", false, "print a new key and exit")
+	return func(args []string) error {
+		if len(args) > 0 {
+			fs.Usage()
+			return errUsage
+		}
+		if *generate {
+			key, err := oauth.GenerateKey()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(env.stdout, key)
+			return nil
+		}
+
+		key, err := oauth.LoadKey(env.globals.CredsKeyFile)
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			return fmt.Errorf("no key provided, set $%s or -creds-key-file", oauth.KeyEnv)
+		}
+
+		for _, name := range []string{cmd.GoogleCredsPath, cmd.ZoomCredsPath} {
+			p := env.globals.Path(name)
+			if _, err := os.Stat(p); os.IsNotExist(err) {
+				env.logger.Printf("%s not found, skipping", p)
+				continue
+			}
+			plaintext := oauth.FileStore{Path: p}
+			encrypted := oauth.EncryptedFileStore{Path: p, Key: key}
+
+			token, err := encrypted.Load()
+			isEncrypted := !errors.Is(err, oauth.ErrNotEncrypted)
+			if isEncrypted && err != nil {
+				return fmt.Errorf("while loading %s: %w", p, err)
+			}
+
+			var to oauth.Store
+			switch {
+			case *decrypt && isEncrypted:
+				to = plaintext
+			case !*decrypt && !isEncrypted:
+				if token, err = plaintext.Load(); err != nil {
+					return fmt.Errorf("while loading %s: %w", p, err)
+				}
+				to = encrypted
+			default:
+				env.logger.Printf("%s already migrated, skipping", p)
+				continue
+			}
+			if err := to.Save(token); err != nil {
+				return fmt.Errorf("while saving %s: %w", p, err)
+			}
+			env.logger.Printf("migrated %s", p)
+		}
+		return nil
+	}
+}
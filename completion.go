@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/graphaelli/zat/cmd"
+)
+
+func setupCompletion(fs *flag.FlagSet, env *cliEnv) func(args []string) error {
+	return func(args []string) error {
+		if len(args) != 1 {
+			fs.Usage()
+			return errUsage
+		}
+		switch args[0] {
+		case "bash":
+			return writeCompletion(env.stdout, false)
+		case "zsh":
+			return writeCompletion(env.stdout, true)
+		default:
+			return fmt.Errorf("unsupported shell %q, use bash or zsh", args[0])
+		}
+	}
+}
+
+// completionWords maps each command path to the words that may follow it: subcommands or flags.
+// Boolean flags, which take no value, are also returned.
+func completionWords(c *command, path []string, words map[string][]string, bools map[string]bool) {
+	key := strings.Join(path, " ")
+	if len(c.subcommands) > 0 {
+		for _, sub := range c.subcommands {
+			words[key] = append(words[key], sub.name)
+			completionWords(sub, append(path, sub.name), words, bools)
+		}
+		return
+	}
+	fs := flag.NewFlagSet(key, flag.ContinueOnError)
+	env := &cliEnv{globals: cmd.NewGlobals(), stdout: ioutil.Discard, stderr: ioutil.Discard}
+	env.globals.Register(fs)
+	c.setup(fs, env)
+	fs.VisitAll(func(f *flag.Flag) {
+		words[key] = append(words[key], "-"+f.Name)
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			bools["-"+f.Name] = true
+		}
+	})
+}
+
+// writeCompletion prints a bash completion script, zsh loads it through bashcompinit
+func writeCompletion(w io.Writer, zsh bool) error {
+	words := make(map[string][]string)
+	bools := make(map[string]bool)
+	completionWords(&command{name: "zat", subcommands: commands()}, nil, words, bools)
+
+	paths := make([]string, 0, len(words))
+	for p := range words {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	boolFlags := make([]string, 0, len(bools))
+	for b := range bools {
+		boolFlags = append(boolFlags, b)
+	}
+	sort.Strings(boolFlags)
+
+	var b strings.Builder
+	if zsh {
+		b.WriteString("# zsh completion for zat, load with: source <(zat completion zsh)\n")
+		b.WriteString("autoload -U +X bashcompinit && bashcompinit\n")
+	} else {
+		b.WriteString("# bash completion for zat, load with: source <(zat completion bash)\n")
+	}
+	b.WriteString(`_zat() {
+    local cur="${COMP_WORDS[COMP_CWORD]}" cmdpath="" skip="" i word
+    for ((i = 1; i < COMP_CWORD; i++)); do
+        word="${COMP_WORDS[i]}"
+        if [[ -n "$skip" ]]; then
+            skip=""
+        elif [[ "$word" == -* ]]; then
+            case " ` + strings.Join(boolFlags, " ") + ` " in
+                *" ${word%%=*} "*) ;;
+                *) [[ "$word" != *=* ]] && skip=1 ;;
+            esac
+        else
+            cmdpath="${cmdpath:+$cmdpath }$word"
+        fi
+    done
+    local words=""
+    case "$cmdpath" in
+`)
+	for _, p := range paths {
+		fmt.Fprintf(&b, "        %q) words=%q ;;\n", p, strings.Join(words[p], " "))
+	}
+	b.WriteString(`    esac
+    COMPREPLY=($(compgen -W "$words" -- "$cur"))
+}
+complete -o default -F _zat zat
+`)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
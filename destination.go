@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.elastic.co/apm"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+
+	"github.com/graphaelli/zat/atomicfile"
+	"github.com/graphaelli/zat/google"
+)
+
+// a directive's google destination is a folder ID, or a path prefixed with one of these
+const (
+	sharedDrivePrefix = "shared-drive:"
+	myDrivePrefix     = "my-drive:"
+)
+
+// destination is where a directive archives meetings
+type destination struct {
+	// folderID is set for destinations given by ID
+	folderID string
+	// sharedDrive names the shared drive a path is in, empty for My Drive
+	sharedDrive string
+	path        []string
+}
+
+// parseDestination parses a folder ID, shared-drive:Name/a/b or my-drive:a/b
+func parseDestination(s string) (destination, error) {
+	var (
+		d destination
+		p string
+	)
+	switch {
+	case strings.HasPrefix(s, sharedDrivePrefix):
+		parts := strings.SplitN(strings.TrimPrefix(s, sharedDrivePrefix), "/", 2)
+		if d.sharedDrive = parts[0]; d.sharedDrive == "" {
+			return d, fmt.Errorf("shared drive name missing in %q", s)
+		}
+		if len(parts) == 2 {
+			p = parts[1]
+		}
+	case strings.HasPrefix(s, myDrivePrefix):
+		p = strings.TrimPrefix(s, myDrivePrefix)
+	case strings.Contains(s, "/"):
+		return d, fmt.Errorf("%q is not a folder ID, prefix paths with %s<name>/ or %s", s, sharedDrivePrefix, myDrivePrefix)
+	default:
+		d.folderID = s
+		return d, nil
+	}
+	if p = strings.Trim(p, "/"); p != "" {
+		for _, name := range strings.Split(p, "/") {
+			if strings.TrimSpace(name) == "" {
+				return d, fmt.Errorf("empty folder name in %q", s)
+			}
+			d.path = append(d.path, name)
+		}
+	}
+	return d, nil
+}
+
+// name is the expected name of the destination folder, empty for the root of a drive
+func (d destination) name() string {
+	if len(d.path) == 0 {
+		return ""
+	}
+	return d.path[len(d.path)-1]
+}
+
+// folderCache persists the folder IDs path destinations resolved to
+type folderCache struct {
+	mu      sync.Mutex
+	path    string
+	folders map[string]string
+}
+
+func newFolderCache(path string) *folderCache {
+	return &folderCache{path: path, folders: make(map[string]string)}
+}
+
+// loadFolderCache reads resolved folders from path, a missing file has none
+func loadFolderCache(path string) (*folderCache, error) {
+	c := newFolderCache(path)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c.folders); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *folderCache) get(dest string) string {
+	if c == nil {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.folders[dest]
+}
+
+// set remembers the folder dest resolved to, an empty id forgets it
+func (c *folderCache) set(dest, id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id == "" {
+		delete(c.folders, dest)
+		return
+	}
+	c.folders[dest] = id
+}
+
+// destinations lists the cached destinations, sorted
+func (c *folderCache) destinations() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dests := make([]string, 0, len(c.folders))
+	for dest := range c.folders {
+		dests = append(dests, dest)
+	}
+	sort.Strings(dests)
+	return dests
+}
+
+// save persists resolved folders, an in memory cache without a path is not saved
+func (c *folderCache) save() error {
+	if c == nil || c.path == "" {
+		return nil
+	}
+	c.mu.Lock()
+	b, err := json.MarshalIndent(c.folders, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(c.path, b)
+}
+
+// validate forgets cached folders that were deleted, trashed or renamed, so they are resolved again when next used
+func (c *folderCache) validate(ctx context.Context, gdrive *google.Drive, logger *log.Logger) {
+	span, ctx := apm.StartSpan(ctx, "validateFolders", "app")
+	defer span.End()
+
+	for _, dest := range c.destinations() {
+		id := c.get(dest)
+		d, err := parseDestination(dest)
+		if err != nil || d.folderID != "" {
+			c.set(dest, "")
+			continue
+		}
+		f, err := gdrive.GetFile(ctx, id, "id, name, mimeType, trashed")
+		reason := ""
+		var apiErr *googleapi.Error
+		switch {
+		case errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+			reason = "not found"
+		case err != nil:
+			// keep it, the folder may well still be there
+			logger.Printf("failed to check folder %s of %s: %s", id, dest, err)
+		case f.Trashed:
+			reason = "trashed"
+		case f.MimeType != google.MimeTypeFolder:
+			reason = "not a folder"
+		case d.name() != "" && f.Name != d.name():
+			reason = fmt.Sprintf("renamed to %q", f.Name)
+		}
+		if reason != "" {
+			logger.Printf("forgetting folder %s of %s: %s", id, dest, reason)
+			c.set(dest, "")
+		}
+	}
+}
+
+// destinationFolder finds the folder the meetings of action are archived in.
+// The folders of path destinations are created as needed, like mkdir -p.
+func (z *Config) destinationFolder(ctx context.Context, gdrive *google.Drive, action Directive) (*drive.File, error) {
+	span, ctx := apm.StartSpan(ctx, "destinationFolder", "app")
+	defer span.End()
+
+	dest, err := parseDestination(action.Google)
+	if err != nil {
+		return nil, err
+	}
+	if dest.folderID != "" {
+		return gdrive.GetFile(ctx, dest.folderID)
+	}
+	if id := z.folders.get(action.Google); id != "" {
+		return &drive.File{Id: id, Name: dest.name(), MimeType: google.MimeTypeFolder}, nil
+	}
+
+	var parent *drive.File
+	if dest.sharedDrive != "" {
+		drives, err := gdrive.FindSharedDrives(ctx, dest.sharedDrive)
+		if err != nil {
+			return nil, fmt.Errorf("while finding shared drive %q: %w", dest.sharedDrive, err)
+		}
+		if len(drives) != 1 {
+			return nil, fmt.Errorf("%d shared drives named %q, expected 1", len(drives), dest.sharedDrive)
+		}
+		// the ID of a shared drive is also the ID of its root folder
+		parent = &drive.File{Id: drives[0].Id, Name: drives[0].Name, MimeType: google.MimeTypeFolder}
+	} else {
+		if parent, err = gdrive.GetFile(ctx, "root"); err != nil {
+			return nil, fmt.Errorf("while finding My Drive: %w", err)
+		}
+	}
+	for _, name := range dest.path {
+		folder, err, created := mkdir(ctx, gdrive, parent, name, nil)
+		if err != nil {
+			return nil, fmt.Errorf("while finding folder %q in %q: %w", name, parent.Name, err)
+		}
+		if created {
+			z.logger.Printf("created folder %q in %q for %s", name, parent.Name, action.Google)
+		}
+		parent = folder
+	}
+	z.folders.set(action.Google, parent.Id)
+	return parent, nil
+}
+
+// loadFolders reads the folders destinations resolved to on earlier runs, checking they are still usable
+func (z *Config) loadFolders(ctx context.Context, gdrive *google.Drive) {
+	if z.foldersPath == "" {
+		return
+	}
+	folders, err := loadFolderCache(z.foldersPath)
+	if err != nil {
+		z.logger.Printf("failed to load resolved folders from %s: %s", z.foldersPath, err)
+		folders = newFolderCache(z.foldersPath)
+	}
+	folders.validate(ctx, gdrive, z.logger)
+	z.folders = folders
+}
+
+func (z *Config) saveFolders() {
+	if err := z.folders.save(); err != nil {
+		z.logger.Printf("failed to save resolved folders to %s: %s", z.foldersPath, err)
+	}
+}
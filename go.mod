@@ -8,7 +8,7 @@ require (
 	go.elastic.co/apm v1.14.0
 	go.elastic.co/apm/module/apmhttp v1.14.0
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
-	golang.org/x/sys v0.0.0-20220928140112-f11e5e49a4ec // indirect
+	golang.org/x/sys v0.0.0-20220928140112-f11e5e49a4ec
 	google.golang.org/api v0.10.0
 	gopkg.in/yaml.v2 v2.2.4
 )
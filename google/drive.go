@@ -0,0 +1,358 @@
+package google
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// DefaultDriveQPS keeps well under drive's default per user quota of 1000 requests per 100 seconds
+	DefaultDriveQPS = 5
+	// DefaultMaxRetries is how many times a failed drive call is retried
+	DefaultMaxRetries = 5
+	// DefaultRetryBackoff is the initial wait between retries, doubling after each attempt
+	DefaultRetryBackoff = time.Second
+	// maxRetryWait caps the wait between retries
+	maxRetryWait = time.Minute
+)
+
+// error reasons drive reports for quota failures, usually with a 403 status
+// https://developers.google.com/drive/api/v3/handle-errors
+var retryableReasons = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+	"backendError":          true,
+}
+
+// Retryable reports whether a drive call failing with err may succeed if retried.
+func Retryable(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError {
+		return true
+	}
+	for _, e := range apiErr.Errors {
+		if retryableReasons[e.Reason] {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimited reports whether a drive call failing with err was turned away by a rate limit, before drive acted on it.
+// Unlike server errors, these are safe to retry for calls that aren't idempotent, such as creating files.
+func RateLimited(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == http.StatusTooManyRequests {
+		return true
+	}
+	for _, e := range apiErr.Errors {
+		if e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+// DriveOption configures the retry and rate limiting behavior of drive calls.
+func DriveOption(qps float64, maxRetries int, backoff time.Duration) ClientOption {
+	return func(c *Client) {
+		c.driveQPS = qps
+		c.maxRetries = maxRetries
+		c.retryBackoff = backoff
+	}
+}
+
+// limiter spaces out calls to stay within a requests per second budget.
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newLimiter(qps float64) *limiter {
+	if qps <= 0 {
+		return &limiter{}
+	}
+	return &limiter{interval: time.Duration(float64(time.Second) / qps)}
+}
+
+// wait blocks until the next call is allowed
+func (l *limiter) wait(ctx context.Context) error {
+	if l.interval == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+	return sleep(ctx, delay)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Drive wraps the drive service, retrying calls that fail due to rate limits or server errors
+// with exponential backoff and keeping calls within a requests per second budget.
+type Drive struct {
+	*drive.Service
+	logger       *log.Logger
+	limiter      *limiter
+	maxRetries   int
+	retryBackoff time.Duration
+}
+
+// Drive returns a drive service sharing the client's rate limit.
+func (c *Client) Drive(ctx context.Context) (*Drive, error) {
+	service, err := c.Service(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Drive{
+		Service:      service,
+		logger:       c.logger,
+		limiter:      c.limiter,
+		maxRetries:   c.maxRetries,
+		retryBackoff: c.retryBackoff,
+	}, nil
+}
+
+// Do runs call, a single drive request, retrying it as needed. op describes the call in errors.
+func (d *Drive) Do(ctx context.Context, op string, call func() error) error {
+	return d.do(ctx, op, Retryable, call)
+}
+
+func (d *Drive) do(ctx context.Context, op string, retryable func(error) bool, call func() error) error {
+	for attempt := 0; ; attempt++ {
+		if err := d.limiter.wait(ctx); err != nil {
+			return fmt.Errorf("while %s: %w", op, err)
+		}
+		err := call()
+		if err == nil {
+			return nil
+		}
+		if attempt >= d.maxRetries || !retryable(err) {
+			return fmt.Errorf("while %s: %w", op, err)
+		}
+		wait := d.retryBackoff << uint(attempt)
+		if wait <= 0 || wait > maxRetryWait {
+			wait = maxRetryWait
+		}
+		// jitter spreads out retries from concurrent callers
+		wait = wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+		d.logger.Printf("%s failed, retrying in %s: %s", op, wait.Round(time.Millisecond), err)
+		if serr := sleep(ctx, wait); serr != nil {
+			return fmt.Errorf("while %s: %w", op, err)
+		}
+	}
+}
+
+// GetFile gets file metadata by ID. fields selects the file fields returned, defaulting to drive's.
+func (d *Drive) GetFile(ctx context.Context, id string, fields ...googleapi.Field) (*drive.File, error) {
+	var file *drive.File
+	err := d.Do(ctx, fmt.Sprintf("getting file %s", id), func() (err error) {
+		call := d.Files.Get(id).Context(ctx).SupportsAllDrives(true)
+		if len(fields) > 0 {
+			call = call.Fields(fields...)
+		}
+		file, err = call.Do()
+		return err
+	})
+	return file, err
+}
+
+// Download fetches the content of file id. rangeHeader, when set, requests part of it, eg "bytes=0-1023".
+// The caller must close the response body.
+func (d *Drive) Download(ctx context.Context, id string, rangeHeader string) (*http.Response, error) {
+	var rsp *http.Response
+	err := d.Do(ctx, fmt.Sprintf("downloading %s", id), func() (err error) {
+		call := d.Files.Get(id).Context(ctx).SupportsAllDrives(true)
+		if rangeHeader != "" {
+			call.Header().Set("Range", rangeHeader)
+		}
+		rsp, err = call.Download()
+		return err
+	})
+	return rsp, err
+}
+
+// FindSharedDrives lists the shared drives named name that are accessible.
+func (d *Drive) FindSharedDrives(ctx context.Context, name string) ([]*drive.Drive, error) {
+	var found []*drive.Drive
+	pageToken := ""
+	for {
+		var list *drive.DriveList
+		err := d.Do(ctx, fmt.Sprintf("finding shared drive %s", name), func() (err error) {
+			call := d.Drives.List().Context(ctx).Q(fmt.Sprintf("name = %q", name))
+			if pageToken != "" {
+				call = call.PageToken(pageToken)
+			}
+			list, err = call.Do()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, list.Drives...)
+		if list.NextPageToken == "" {
+			return found, nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
+
+// ListFiles lists files matching q, a page at a time. fields selects the file fields returned, defaulting to drive's.
+func (d *Drive) ListFiles(ctx context.Context, q string, pageToken string, fields ...googleapi.Field) (*drive.FileList, error) {
+	var list *drive.FileList
+	err := d.Do(ctx, fmt.Sprintf("listing files %s", q), func() (err error) {
+		call := d.Files.List().Context(ctx).SupportsTeamDrives(true).IncludeTeamDriveItems(true).Q(q)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		if len(fields) > 0 {
+			call = call.Fields(fields...)
+		}
+		list, err = call.Do()
+		return err
+	})
+	return list, err
+}
+
+// CreateFile creates file, with media as its content when not nil.
+// Media that can't be rewound, ie doesn't implement io.Seeker, is spooled to disk first so uploads can be retried.
+// Only rate limited creates are retried, drive may have created the file before failing with a server error.
+func (d *Drive) CreateFile(ctx context.Context, file *drive.File, media io.Reader, opts ...googleapi.MediaOption) (*drive.File, error) {
+	if media != nil {
+		var cleanup func()
+		var err error
+		if media, cleanup, err = d.rewindable(media); err != nil {
+			return nil, fmt.Errorf("while creating %q: %w", file.Name, err)
+		}
+		defer cleanup()
+	}
+	var created *drive.File
+	attempt := 0
+	err := d.do(ctx, fmt.Sprintf("creating %q", file.Name), RateLimited, func() (err error) {
+		call := d.Files.Create(file).Context(ctx).SupportsAllDrives(true)
+		if media != nil {
+			if err := rewind(media, attempt); err != nil {
+				return err
+			}
+			call = call.Media(media, opts...)
+		}
+		attempt++
+		created, err = call.Do()
+		return err
+	})
+	return created, err
+}
+
+// UpdateFile updates the metadata of file id, only fields set in file are changed.
+func (d *Drive) UpdateFile(ctx context.Context, id string, file *drive.File) (*drive.File, error) {
+	var updated *drive.File
+	err := d.Do(ctx, fmt.Sprintf("updating %s", id), func() (err error) {
+		updated, err = d.Files.Update(id, file).Context(ctx).SupportsAllDrives(true).Do()
+		return err
+	})
+	return updated, err
+}
+
+// UpdateContent replaces the content of file id with media, along with the metadata set in file.
+// Media that can't be rewound is spooled to disk first so uploads can be retried.
+func (d *Drive) UpdateContent(ctx context.Context, id string, file *drive.File, media io.Reader, opts ...googleapi.MediaOption) (*drive.File, error) {
+	media, cleanup, err := d.rewindable(media)
+	if err != nil {
+		return nil, fmt.Errorf("while updating content of %s: %w", id, err)
+	}
+	defer cleanup()
+	var updated *drive.File
+	attempt := 0
+	err = d.Do(ctx, fmt.Sprintf("updating content of %s", id), func() (err error) {
+		if err := rewind(media, attempt); err != nil {
+			return err
+		}
+		attempt++
+		updated, err = d.Files.Update(id, file).Context(ctx).SupportsAllDrives(true).Media(media, opts...).Do()
+		return err
+	})
+	return updated, err
+}
+
+// rewindable returns media so that a failed upload can be sent again, spooling it to a temporary file
+// unless it implements io.Seeker or uploads aren't retried. cleanup removes any temporary file.
+func (d *Drive) rewindable(media io.Reader) (io.Reader, func(), error) {
+	nop := func() {}
+	if _, ok := media.(io.Seeker); ok || d.maxRetries == 0 {
+		return media, nop, nil
+	}
+	tmp, err := ioutil.TempFile("", "zat-upload-*")
+	if err != nil {
+		return nil, nop, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	if _, err := io.Copy(tmp, media); err != nil {
+		cleanup()
+		return nil, nop, fmt.Errorf("while spooling upload: %w", err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nop, err
+	}
+	return tmp, cleanup, nil
+}
+
+// rewind seeks media from rewindable back to the start before attempts after the first
+func rewind(media io.Reader, attempt int) error {
+	if attempt == 0 {
+		return nil
+	}
+	_, err := media.(io.Seeker).Seek(0, io.SeekStart)
+	return err
+}
+
+// CreatePermission shares fileID according to perm.
+func (d *Drive) CreatePermission(ctx context.Context, fileID string, perm *drive.Permission, sendNotificationEmail bool) error {
+	return d.Do(ctx, fmt.Sprintf("sharing %s with %s", fileID, perm.Type), func() error {
+		call := d.Permissions.Create(fileID, perm).Context(ctx).SupportsAllDrives(true)
+		if perm.Type == "user" || perm.Type == "group" {
+			call = call.SendNotificationEmail(sendNotificationEmail)
+		}
+		_, err := call.Do()
+		return err
+	})
+}
@@ -2,29 +2,47 @@ package google
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jwt"
 	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/option"
+
+	"github.com/graphaelli/zat/oauth"
 )
 
 const (
-	MimeTypeFolder = "application/vnd.google-apps.folder"
+	MimeTypeDocument = "application/vnd.google-apps.document"
+	MimeTypeFolder   = "application/vnd.google-apps.folder"
 )
 
 type Client struct {
 	logger     *log.Logger
 	httpClient *http.Client
 
-	config      *oauth2.Config
-	credentials *oauth2.Token
-	cm          *credentialsManager
+	config *oauth2.Config
+	tokens *oauth.TokenSource
+	login  *oauth.Flow
+
+	// serviceAccount is set instead of config and login when authenticating as a service account
+	serviceAccount *jwt.Config
+	// endpoint overrides the drive API base URL
+	endpoint string
+
+	driveQPS     float64
+	maxRetries   int
+	retryBackoff time.Duration
+	limiter      *limiter
 }
 
 type ClientOption func(*Client)
@@ -35,6 +53,13 @@ func CustomHTTPClientOption(httpClient *http.Client) ClientOption {
 	}
 }
 
+// EndpointOption sends drive API requests to endpoint rather than google, eg a test server
+func EndpointOption(endpoint string) ClientOption {
+	return func(c *Client) {
+		c.endpoint = endpoint
+	}
+}
+
 // Config is a google-defined client_credentials.json format.
 // Duplicated from golang.org/x/oauth2/google since it is not exported.
 type Config struct {
@@ -60,6 +85,15 @@ func NewClientFromReader(logger *log.Logger, r io.Reader, options ...ClientOptio
 	if err != nil {
 		return nil, err
 	}
+	var key serviceAccountKey
+	if err := json.Unmarshal(b, &key); err == nil && key.Type == "service_account" {
+		config, err := google.JWTConfigFromJSON(b, drive.DriveScope)
+		if err != nil {
+			return nil, err
+		}
+		config.Subject = key.Subject
+		return NewServiceAccountClient(logger, config, options...)
+	}
 	// https://developers.google.com/identity/protocols/googlescopes#drivev3
 	config, err := google.ConfigFromJSON(b, drive.DriveScope)
 	if err != nil {
@@ -73,71 +107,144 @@ func NewClient(logger *log.Logger, config *oauth2.Config, options ...ClientOptio
 		logger:     logger,
 		httpClient: http.DefaultClient,
 		config:     config,
+		tokens:     oauth.NewTokenSource(logger, "Google", config),
+		login:      &oauth.Flow{Name: "google", Config: config, PKCE: true},
+
+		driveQPS:     DefaultDriveQPS,
+		maxRetries:   DefaultMaxRetries,
+		retryBackoff: DefaultRetryBackoff,
 	}
 
 	for _, o := range options {
 		o(c)
 	}
+	c.tokens.SetHTTPClient(c.httpClient)
+	c.limiter = newLimiter(c.driveQPS)
 	return c, nil
 }
 
-func (c *Client) updateCreds(token *oauth2.Token) {
-	c.credentials = token
-	if token != nil && c.cm != nil {
-		if err := c.cm.saveCreds(c); err != nil {
-			c.logger.Println("failed to save creds:", err)
+// serviceAccountKey is the part of a service account key zat reads itself,
+// Subject is not part of the key google provides, it can be added to avoid another configuration file.
+type serviceAccountKey struct {
+	Type    string `json:"type"`
+	Subject string `json:"subject"`
+}
+
+// SubjectOption impersonates subject, a user email address, when authenticating as a service account.
+// The service account must be granted domain-wide delegation of the drive scope.
+func SubjectOption(subject string) ClientOption {
+	return func(c *Client) {
+		if c.serviceAccount != nil {
+			c.serviceAccount.Subject = subject
 		}
 	}
 }
 
-func (c *Client) HasCreds() bool {
-	if c.credentials == nil {
-		return false
+// NewServiceAccountClient authenticates as a service account rather than a user, so no login is required.
+// Files it creates are owned by the service account, or by the subject it impersonates, see SubjectOption.
+func NewServiceAccountClient(logger *log.Logger, config *jwt.Config, options ...ClientOption) (*Client, error) {
+	c := &Client{
+		logger:         logger,
+		httpClient:     http.DefaultClient,
+		serviceAccount: config,
+
+		driveQPS:     DefaultDriveQPS,
+		maxRetries:   DefaultMaxRetries,
+		retryBackoff: DefaultRetryBackoff,
 	}
+	c.tokens = oauth.NewServiceTokenSource(logger, "Google", func(ctx context.Context) oauth2.TokenSource {
+		return c.serviceAccount.TokenSource(ctx)
+	})
 
-	valid := c.credentials.Valid()
+	for _, o := range options {
+		o(c)
+	}
+	c.tokens.SetHTTPClient(c.httpClient)
+	c.limiter = newLimiter(c.driveQPS)
+	return c, nil
+}
 
-	if !valid {
-		c.logger.Println("Google credentials not valid, updating token")
-		src := c.config.TokenSource(context.TODO(), c.credentials)
-		newToken, err := src.Token() // this actually goes and renews the tokens
-		if err != nil {
-			c.logger.Printf("error updating google token %s", err)
-			return false
-		}
-		if newToken.AccessToken != c.credentials.AccessToken {
-			c.updateCreds(newToken)
-			c.credentials = newToken
-			c.logger.Println("Google credentials updated and saved to disk")
-		}
+// ServiceAccount reports the service account in use, and the user it impersonates if any.
+// email is empty when authenticating as a user.
+func (c *Client) ServiceAccount() (email, subject string) {
+	if c.serviceAccount == nil {
+		return "", ""
 	}
-	return true
+	return c.serviceAccount.Email, c.serviceAccount.Subject
+}
+
+func (c *Client) updateCreds(token *oauth2.Token) {
+	c.tokens.Set(token)
+}
+
+// HasCreds reports whether usable credentials are available, refreshing them if needed.
+func (c *Client) HasCreds() bool {
+	return c.tokens.Valid()
+}
+
+// TokenSource provides the current access token, refreshing as needed.
+func (c *Client) TokenSource() oauth2.TokenSource {
+	return c.tokens
+}
+
+// TokenStatus reports the outcome of the last token refresh.
+func (c *Client) TokenStatus() (time.Time, error) {
+	return c.tokens.Status()
 }
 
+// RefreshInBackground keeps credentials fresh until ctx is done.
+func (c *Client) RefreshInBackground(ctx context.Context, onError func(error)) {
+	go c.tokens.Run(ctx, onError)
+}
+
+// ErrServiceAccount is returned when logging in, which a service account doesn't need
+var ErrServiceAccount = errors.New("google is configured with a service account, no login is needed")
+
 func (c *Client) OauthRedirect(w http.ResponseWriter, r *http.Request) {
+	if c.serviceAccount != nil {
+		http.Error(w, fmt.Sprintf("%s, check its key and delegation", ErrServiceAccount), http.StatusInternalServerError)
+		return
+	}
 	c.logger.Println(c.config.RedirectURL)
 	http.Redirect(w, r, c.config.RedirectURL, http.StatusFound)
 }
 
-// TODO: use / validate state token
+// LoginFlow is the login flow, for logging in from a terminal, along with the options it needs to obtain a refresh token.
+// The flow is nil for service accounts.
+func (c *Client) LoginFlow() (*oauth.Flow, []oauth2.AuthCodeOption) {
+	return c.login, []oauth2.AuthCodeOption{oauth2.AccessTypeOffline, oauth2.ApprovalForce}
+}
+
+// SetCreds replaces the credentials after a login, persisting them.
+func (c *Client) SetCreds(token *oauth2.Token) error {
+	c.updateCreds(token)
+	_, err := c.tokens.Status()
+	return err
+}
+
 func (c *Client) OauthHandler() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.FormValue("refresh") != "" || !c.credentials.Valid() {
-			c.updateCreds(nil)
+		if c.serviceAccount != nil {
+			c.OauthRedirect(w, r)
+			return
 		}
-
-		code := r.FormValue("code")
-		if code == "" {
-			redirectTo := c.config.AuthCodeURL("state-token", oauth2.AccessTypeOffline, oauth2.ApprovalForce)
+		// current credentials are kept until the login succeeds, replacing them
+		if !oauth.IsCallback(r) {
+			redirectTo, err := c.login.AuthCodeURL(w, r, oauth2.AccessTypeOffline, oauth2.ApprovalForce)
+			if err != nil {
+				c.logger.Print(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 			c.logger.Print("no code provided, sending to google auth ", redirectTo)
 			http.Redirect(w, r, redirectTo, http.StatusFound)
 			return
 		}
 
 		// exchange for token
-		if token, err := c.config.Exchange(context.TODO(), code); err != nil {
-			c.logger.Print(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if token, err := c.login.Exchange(r.Context(), w, r); err != nil {
+			c.logger.Print("google login failed: ", err)
+			oauth.ErrorPage(w, "Google", err, r.URL.Path)
 			return
 		} else {
 			c.updateCreds(token)
@@ -148,18 +255,29 @@ func (c *Client) OauthHandler() func(w http.ResponseWriter, r *http.Request) {
 }
 
 func (c *Client) Service(ctx context.Context) (*drive.Service, error) {
-	return drive.NewService(ctx, option.WithTokenSource(c.config.TokenSource(ctx, c.credentials)))
+	options := []option.ClientOption{option.WithTokenSource(c.tokens)}
+	if c.endpoint != "" {
+		options = append(options, option.WithEndpoint(c.endpoint))
+	}
+	return drive.NewService(ctx, options...)
 }
 
 func (c *Client) ListFiles(ctx context.Context, q string, pageToken string) (*drive.FileList, error) {
-	driveService, err := c.Service(ctx)
+	gdrive, err := c.Drive(ctx)
 	if err != nil {
 		return nil, err
 	}
+	return gdrive.ListFiles(ctx, q, pageToken)
+}
 
-	l := driveService.Files.List().SupportsTeamDrives(true).IncludeTeamDriveItems(true).Q(q)
-	if pageToken != "" {
-		l.PageToken(pageToken)
+// SignInConfig derives an OpenID Connect sign in configuration from the client configuration,
+// nil for service accounts, which can't sign users in.
+func (c *Client) SignInConfig(redirectURL string, scopes ...string) *oauth2.Config {
+	if c.config == nil {
+		return nil
 	}
-	return l.Do()
+	config := *c.config
+	config.RedirectURL = redirectURL
+	config.Scopes = append([]string{"openid", "email", "profile"}, scopes...)
+	return &config
 }
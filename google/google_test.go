@@ -2,9 +2,26 @@ package google
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
 )
 
 func TestNewClientFromReader(t *testing.T) {
@@ -77,3 +94,234 @@ func TestNewClientFromReader(t *testing.T) {
 		})
 	}
 }
+
+func TestServiceAccount(t *testing.T) {
+	var claims map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		if len(parts) != 3 {
+			t.Fatalf("unexpected assertion %q", r.FormValue("assertion"))
+		}
+		b, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims = nil
+		if err := json.Unmarshal(b, &claims); err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "robot_access_token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	defer server.Close()
+
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := map[string]string{
+		"type":           "service_account",
+		"client_email":   "zat@project.iam.gserviceaccount.com",
+		"private_key_id": "1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(pk)})),
+		"token_uri":      server.URL,
+	}
+
+	for _, tt := range []struct {
+		name    string
+		subject string
+		options []ClientOption
+		want    string
+	}{
+		{name: "robot"},
+		{name: "subject in key", subject: "archiver@example.com", want: "archiver@example.com"},
+		{name: "subject option", options: []ClientOption{SubjectOption("other@example.com")}, want: "other@example.com"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			key["subject"] = tt.subject
+			b, _ := json.Marshal(key)
+			var clog bytes.Buffer
+			c, err := NewClientFromReader(log.New(&clog, "", 0), bytes.NewReader(b), tt.options...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if email, subject := c.ServiceAccount(); email != key["client_email"] || subject != tt.want {
+				t.Errorf("ServiceAccount() = %q, %q", email, subject)
+			}
+			if flow, _ := c.LoginFlow(); flow != nil {
+				t.Error("expected no login flow for a service account")
+			}
+			token, err := c.TokenSource().Token()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.AccessToken != "robot_access_token" {
+				t.Errorf("unexpected access token %q", token.AccessToken)
+			}
+			if claims["iss"] != key["client_email"] || claims["scope"] != "https://www.googleapis.com/auth/drive" {
+				t.Errorf("unexpected claims %v", claims)
+			}
+			if sub, _ := claims["sub"].(string); sub != tt.want {
+				t.Errorf("got subject %q, want %q", sub, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: errors.New("boom"), want: false},
+		{err: &googleapi.Error{Code: http.StatusNotFound}, want: false},
+		{err: &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "insufficientFilePermissions"}}}, want: false},
+		{err: &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}}, want: true},
+		{err: &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, want: true},
+		{err: &googleapi.Error{Code: http.StatusTooManyRequests}, want: true},
+		{err: fmt.Errorf("wrapped: %w", &googleapi.Error{Code: http.StatusServiceUnavailable}), want: true},
+	}
+	for _, tt := range tests {
+		if got := Retryable(tt.err); got != tt.want {
+			t.Errorf("Retryable(%v) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	if !RateLimited(&googleapi.Error{Code: http.StatusTooManyRequests}) ||
+		!RateLimited(&googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}}) {
+		t.Error("expected rate limits to be detected")
+	}
+	if RateLimited(&googleapi.Error{Code: http.StatusInternalServerError, Errors: []googleapi.ErrorItem{{Reason: "backendError"}}}) ||
+		RateLimited(errors.New("boom")) {
+		t.Error("expected server errors not to be rate limits")
+	}
+}
+
+func TestDriveRetries(t *testing.T) {
+	var logs bytes.Buffer
+	d := &Drive{
+		logger:       log.New(&logs, "", 0),
+		limiter:      newLimiter(0),
+		maxRetries:   2,
+		retryBackoff: time.Millisecond,
+	}
+	ctx := context.Background()
+
+	calls := 0
+	err := d.Do(ctx, "listing", func() error {
+		calls++
+		if calls < 3 {
+			return &googleapi.Error{Code: http.StatusInternalServerError}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("expected success after 3 calls, got %d: %v", calls, err)
+	}
+
+	calls = 0
+	err = d.Do(ctx, "listing", func() error {
+		calls++
+		return &googleapi.Error{Code: http.StatusNotFound}
+	})
+	var apiErr *googleapi.Error
+	if calls != 1 || !errors.As(err, &apiErr) || apiErr.Code != http.StatusNotFound {
+		t.Errorf("expected single call not found error, got %d: %v", calls, err)
+	}
+
+	calls = 0
+	err = d.Do(ctx, "listing", func() error {
+		calls++
+		return &googleapi.Error{Code: http.StatusTooManyRequests}
+	})
+	if calls != 3 || err == nil {
+		t.Errorf("expected error after exhausting retries, got %d: %v", calls, err)
+	}
+}
+
+func TestDriveRetriesUpload(t *testing.T) {
+	var uploads []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		uploads = append(uploads, string(body))
+		w.Header().Set("Content-Type", "application/json")
+		if len(uploads) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error":{"code":429,"message":"slow down","errors":[{"reason":"rateLimitExceeded"}]}}`)
+			return
+		}
+		fmt.Fprint(w, `{"id":"uploaded"}`)
+	}))
+	defer server.Close()
+	service, err := drive.New(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.BasePath = server.URL + "/"
+	d := &Drive{
+		Service:      service,
+		logger:       log.New(ioutil.Discard, "", 0),
+		limiter:      newLimiter(0),
+		maxRetries:   2,
+		retryBackoff: time.Millisecond,
+	}
+
+	// streamed media, eg a download, is sent again in full
+	media := io.MultiReader(strings.NewReader("recording "), strings.NewReader("content"))
+	created, err := d.CreateFile(context.Background(), &drive.File{Name: "recording.mp4"}, media)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Id != "uploaded" || len(uploads) != 2 {
+		t.Fatalf("expected upload after a retry, got %d uploads: %+v", len(uploads), created)
+	}
+	for i, upload := range uploads {
+		if !strings.Contains(upload, "recording content") {
+			t.Errorf("upload %d missing content: %q", i, upload)
+		}
+	}
+
+	// drive may have created the file before failing, creating it again would duplicate it
+	failed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploads = append(uploads, "")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"error":{"code":500,"message":"internal","errors":[{"reason":"backendError"}]}}`)
+	}))
+	defer failed.Close()
+	service.BasePath = failed.URL + "/"
+	uploads = nil
+	if _, err := d.CreateFile(context.Background(), &drive.File{Name: "folder"}, nil); err == nil || len(uploads) != 1 {
+		t.Errorf("expected a single failed create, got %d: %v", len(uploads), err)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(100)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := l.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected calls spaced 10ms apart, took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	slow := newLimiter(0.001)
+	slow.wait(ctx)
+	if err := slow.wait(ctx); err == nil {
+		t.Error("expected error waiting with cancelled context")
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"time"
 
 	"golang.org/x/oauth2"
+
+	"github.com/graphaelli/zat/oauth"
 )
 
 func OauthHandler(t *testing.T, oauthRedirect string) func(w http.ResponseWriter, r *http.Request) {
@@ -16,18 +18,29 @@ func OauthHandler(t *testing.T, oauthRedirect string) func(w http.ResponseWriter
 		t.Error(err)
 	}
 
+	// PKCE challenge of the last authorization request
+	var challenge string
 	return func(w http.ResponseWriter, r *http.Request) {
 		t.Log("mock google handler handling", r.URL.String())
 		if r.URL.Path == "/oauth2/auth" {
 			next := *u
 			v := next.Query()
 			v.Set("code", "acode")
+			if state := r.FormValue("state"); state != "" {
+				v.Set("state", state)
+			}
 			next.RawQuery = v.Encode()
+			challenge = r.FormValue("code_challenge")
 			http.Redirect(w, r, next.String(), http.StatusFound)
 			return
 		}
 
 		if r.URL.Path == "/oauth2/token" {
+			if challenge != "" && oauth.S256Challenge(r.FormValue("code_verifier")) != challenge {
+				t.Error("PKCE code verifier doesn't match challenge")
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
 			w.Header().Set("Content-Type", "application/json")
 			if err := json.NewEncoder(w).Encode(oauth2.Token{
 				AccessToken:  "test_access_token",
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.elastic.co/apm"
+	"google.golang.org/api/drive/v3"
+
+	"github.com/graphaelli/zat/google"
+	"github.com/graphaelli/zat/oauth"
+	"github.com/graphaelli/zat/zoom"
+)
+
+const (
+	// hookSkip is the exit status of a hook declining to archive a file
+	hookSkip = 3
+	// hookTimeout is how long hooks run by default
+	hookTimeout = 10 * time.Minute
+	// hookOutputLimit is the most hook output logged, in bytes
+	hookOutputLimit = 4096
+
+	// propHookSkip tags meeting folders with the files their hook skipped, by recording file id
+	propHookSkip = "zatHookSkip"
+)
+
+// errHookSkip is returned when a hook declines to archive a file
+var errHookSkip = errors.New("skipped by hook")
+
+// Hook runs an external command on each recording downloaded for a directive, before it is archived.
+// The command is run with the path of the downloaded file appended and the meeting as json on stdin.
+// It may replace the file, exit with hookSkip to skip it or with any other error to fail the meeting.
+type Hook struct {
+	// Command is the program to run and its arguments
+	Command []string `json:"command"`
+	// Types lists the file types hooked, all when empty
+	Types []string `json:"types,omitempty"`
+	// Timeout is how long the command may run, hookTimeout when unset
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+func (h *Hook) validate() error {
+	if len(h.Command) == 0 || h.Command[0] == "" {
+		return errors.New("a command is required")
+	}
+	if h.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	return nil
+}
+
+// hooks reports whether h runs on f
+func (h *Hook) hooks(f zoom.RecordingFile) bool {
+	return h != nil && (len(h.Types) == 0 || containsFold(h.Types, f.FileType))
+}
+
+// fingerprint identifies the hook command, files it skipped are hooked again once the command changes
+func (h *Hook) fingerprint() string {
+	sum := sha256.Sum256([]byte(strings.Join(h.Command, "\x00")))
+	return hex.EncodeToString(sum[:4])
+}
+
+func hookSkipKey(f zoom.RecordingFile) string {
+	return propHookSkip + f.ID
+}
+
+// skipped reports whether h skipped f on an earlier run, as recorded on the meeting folder
+func (h *Hook) skipped(folder *drive.File, f zoom.RecordingFile) bool {
+	return h.hooks(f) && folder.AppProperties[hookSkipKey(f)] == h.fingerprint()
+}
+
+// recordHookSkip records on the meeting folder that h skipped f, so it isn't downloaded and hooked again on later runs
+func (z *Config) recordHookSkip(ctx context.Context, gdrive *google.Drive, folder *drive.File, h *Hook, f zoom.RecordingFile) {
+	props := map[string]string{hookSkipKey(f): h.fingerprint()}
+	if _, err := gdrive.UpdateFile(ctx, folder.Id, &drive.File{AppProperties: props}); err != nil {
+		z.logger.Printf("failed to record hook skipping %s: %s", f.ID, err)
+		apm.CaptureError(ctx, err).Send()
+		return
+	}
+	if folder.AppProperties == nil {
+		folder.AppProperties = make(map[string]string)
+	}
+	folder.AppProperties[hookSkipKey(f)] = h.fingerprint()
+}
+
+func (h *Hook) timeout() time.Duration {
+	if h.Timeout > 0 {
+		return h.Timeout
+	}
+	return hookTimeout
+}
+
+// spooledFile is a downloaded recording on disk, removed when closed
+type spooledFile struct {
+	*os.File
+}
+
+func (s spooledFile) Close() error {
+	err := s.File.Close()
+	if rmErr := os.Remove(s.Name()); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// spool writes r to a temporary file named like name, so hooks can tell what it holds
+func spool(r io.Reader, name string) (string, error) {
+	tmp, err := ioutil.TempFile("", "zat-*"+filepath.Ext(name))
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// hookRecording spools the download r of f and runs the hook of action on it,
+// returning the file to archive, as the hook left it, or errHookSkip
+func (z *Config) hookRecording(ctx context.Context, action Directive, meeting zoom.Meeting, folder *drive.File,
+	f zoom.RecordingFile, name string, r io.Reader) (io.ReadCloser, error) {
+	span, ctx := apm.StartSpan(ctx, "hookRecording", "app")
+	defer span.End()
+
+	path, err := spool(r, name)
+	if err != nil {
+		return nil, fmt.Errorf("while spooling download: %w", err)
+	}
+	stdin, err := json.Marshal(newMeetingMetadata(meeting, folder, nil))
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("while encoding meeting: %w", err)
+	}
+	hook := action.Hook
+	command := append(append([]string{}, hook.Command...), path)
+	if err := z.runCommand(ctx, hook.timeout(), command, stdin,
+		"ZAT_DIRECTIVE="+action.Name,
+		"ZAT_MEETING_ID="+strconv.FormatInt(meeting.ID, 10),
+		"ZAT_MEETING_UUID="+meeting.UUID,
+		"ZAT_RECORDING_ID="+f.ID,
+		"ZAT_FILE="+path,
+		"ZAT_FILE_NAME="+name,
+		"ZAT_FILE_TYPE="+strings.ToLower(f.FileType),
+		"ZAT_RECORDING_TYPE="+f.RecordingType,
+	); err != nil {
+		os.Remove(path)
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == hookSkip {
+			return nil, errHookSkip
+		}
+		return nil, err
+	}
+	// the hook may have replaced the file, open it again
+	file, err := os.Open(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("while opening hooked file: %w", err)
+	}
+	return spooledFile{file}, nil
+}
+
+// runCommand runs command with stdin and env added to the environment for at most timeout, logging its output
+func (z *Config) runCommand(ctx context.Context, timeout time.Duration, command []string, stdin []byte, env ...string) error {
+	out, err := commandOutput(ctx, timeout, command, stdin, env...)
+	z.logOutput(command, out)
+	return err
+}
+
+// logOutput logs what command wrote, up to hookOutputLimit
+func (z *Config) logOutput(command []string, out []byte) {
+	if output := strings.TrimSpace(string(out)); output != "" {
+		if len(output) > hookOutputLimit {
+			output = output[:hookOutputLimit] + "…"
+		}
+		z.logger.Printf("%s: %s", filepath.Base(command[0]), output)
+	}
+}
+
+// commandOutput runs command with stdin and env added to the environment for at most timeout,
+// returning what it wrote to stdout and stderr
+func commandOutput(ctx context.Context, timeout time.Duration, command []string, stdin []byte, env ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(commandEnv(), env...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return out.Bytes(), fmt.Errorf("%s timed out after %s", filepath.Base(command[0]), timeout)
+	}
+	return out.Bytes(), err
+}
+
+// commandEnv is the environment of commands zat runs, without the credentials encryption key
+func commandEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, oauth.KeyEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// runSummary describes a meeting archived by Run, for post-run hooks
+type runSummary struct {
+	Topic     string `json:"topic"`
+	Date      string `json:"date"`
+	Status    string `json:"status"`
+	Files     int    `json:"files"`
+	ShareURL  string `json:"share_url,omitempty"`
+	FolderURL string `json:"folder_url,omitempty"`
+}
+
+// shellCommand runs command with the shell, as pre-run and post-run hooks are given on the command line
+func shellCommand(command string) []string {
+	return []string{"sh", "-c", command}
+}
+
+// preRunHook runs before archiving, archiving is skipped when it fails
+func (z *Config) preRunHook(ctx context.Context) error {
+	if z.preRun == "" {
+		return nil
+	}
+	span, ctx := apm.StartSpan(ctx, "preRunHook", "app")
+	defer span.End()
+	if err := z.runCommand(ctx, hookTimeout, shellCommand(z.preRun), nil); err != nil {
+		return fmt.Errorf("while running pre-run hook: %w", err)
+	}
+	return nil
+}
+
+// postRunHook runs after archiving with the meetings archived as json on stdin, and the error archiving stopped at
+func (z *Config) postRunHook(ctx context.Context, runErr error) {
+	if z.postRun == "" {
+		return
+	}
+	span, ctx := apm.StartSpan(ctx, "postRunHook", "app")
+	defer span.End()
+	summary := make([]runSummary, len(archDetails))
+	for i, m := range archDetails {
+		summary[i] = runSummary{
+			Topic:     m.name,
+			Date:      m.date,
+			Status:    m.status,
+			Files:     m.fileNumber,
+			ShareURL:  m.zoomUrl,
+			FolderURL: m.googleDriveURL,
+		}
+	}
+	stdin, err := json.Marshal(summary)
+	if err != nil {
+		z.logger.Printf("failed to encode run summary: %s", err)
+		return
+	}
+	var env []string
+	if runErr != nil {
+		env = append(env, "ZAT_ERROR="+runErr.Error())
+	}
+	if err := z.runCommand(ctx, hookTimeout, shellCommand(z.postRun), stdin, env...); err != nil {
+		z.logger.Printf("post-run hook failed: %s", err)
+		apm.CaptureError(ctx, err).Send()
+	}
+}
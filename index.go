@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"google.golang.org/api/drive/v3"
+
+	"github.com/graphaelli/zat/search"
+	"github.com/graphaelli/zat/zoom"
+	"github.com/graphaelli/zat/zoom/chatlog"
+	"github.com/graphaelli/zat/zoom/vtt"
+)
+
+// searchLimit is the most search results shown
+const searchLimit = 50
+
+// searchID identifies the indexed content of recording f, which is the same wherever it is archived
+func searchID(meeting zoom.Meeting, f zoom.RecordingFile) string {
+	return meeting.UUID + "/" + f.ID
+}
+
+// indexes reports whether f is searchable once archived
+func (z *Config) indexes(f zoom.RecordingFile) bool {
+	return z.index != nil && (isTranscript(f) || isChat(f))
+}
+
+// needsIndex reports whether f is searchable but not yet indexed, archived before the index was
+func (z *Config) needsIndex(meeting zoom.Meeting, f zoom.RecordingFile) bool {
+	return z.indexes(f) && !z.index.Has(searchID(meeting, f))
+}
+
+// searchDocument parses the transcript or chat log content of f for indexing
+func searchDocument(meeting zoom.Meeting, f zoom.RecordingFile, folder *drive.File, content []byte) (search.Document, error) {
+	recordingStart, err := time.Parse(time.RFC3339, f.RecordingStart)
+	if err != nil {
+		recordingStart = meeting.StartTime
+	}
+	doc := search.Document{
+		ID:             searchID(meeting, f),
+		MeetingUUID:    meeting.UUID,
+		MeetingID:      meeting.ID,
+		Topic:          meeting.Topic,
+		Start:          meeting.StartTime,
+		Kind:           recordingType(f),
+		RecordingStart: recordingStart,
+		ShareURL:       meeting.ShareURL,
+		FolderURL:      "https://drive.google.com/drive/folders/" + folder.Id,
+	}
+	switch {
+	case isTranscript(f):
+		cues, err := vtt.Parse(bytes.NewReader(content))
+		if err != nil {
+			return doc, err
+		}
+		for _, p := range vtt.Paragraphs(cues) {
+			doc.Entries = append(doc.Entries, search.Entry{Offset: p.Start, Speaker: p.Speaker, Text: p.Text})
+		}
+	case isChat(f):
+		messages, err := chatlog.Parse(bytes.NewReader(content))
+		if err != nil {
+			return doc, err
+		}
+		for _, m := range messages {
+			doc.Entries = append(doc.Entries, search.Entry{Offset: m.Offset, Speaker: m.From, Text: m.Text})
+		}
+	default:
+		return doc, fmt.Errorf("%s recordings are not searchable", recordingType(f))
+	}
+	return doc, nil
+}
+
+// indexRecording adds the archived transcript or chat log f to the search index.
+// Search is supplementary, failures are only logged.
+// Content that fails to parse is indexed without entries, so it isn't downloaded again on every run.
+func (z *Config) indexRecording(meeting zoom.Meeting, f zoom.RecordingFile, folder *drive.File, content []byte) {
+	doc, err := searchDocument(meeting, f, folder, content)
+	if err != nil {
+		z.logger.Printf("failed to index %s of %q: %s", recordingType(f), meeting.Topic, err)
+		doc.Entries = nil
+	}
+	z.index.Add(doc)
+}
+
+// loadIndex picks up changes to the search index saved by other processes since it was last read
+func (z *Config) loadIndex() {
+	if z.index == nil {
+		return
+	}
+	if err := z.index.Refresh(); err != nil {
+		z.logger.Printf("failed to load search index from %s: %s", z.indexPath, err)
+	}
+}
+
+func (z *Config) saveIndex() {
+	if z.index == nil {
+		return
+	}
+	if err := z.index.Save(); err != nil {
+		z.logger.Printf("failed to save search index to %s: %s", z.indexPath, err)
+	}
+}
+
+// searchResult is a search match as presented by the web interface and zat search
+type searchResult struct {
+	Topic     string    `json:"topic"`
+	Start     time.Time `json:"start"`
+	MeetingID int64     `json:"meeting_id"`
+	Kind      string    `json:"kind"`
+	// At is the time of the match, relative to the start of the recording
+	At      string `json:"at"`
+	Speaker string `json:"speaker,omitempty"`
+	Snippet string `json:"snippet"`
+	Link    string `json:"link"`
+}
+
+func searchResults(results []search.Result) []searchResult {
+	r := make([]searchResult, len(results))
+	for i, res := range results {
+		r[i] = searchResult{
+			Topic:     res.Document.Topic,
+			Start:     res.Document.Start,
+			MeetingID: res.Document.MeetingID,
+			Kind:      res.Document.Kind,
+			At:        vtt.FormatOffset(res.Entry.Offset),
+			Speaker:   res.Entry.Speaker,
+			Snippet:   res.Snippet,
+			Link:      res.Document.Link(res.Entry),
+		}
+	}
+	return r
+}
+
+// highlight escapes text for html, emphasizing the words of query
+func highlight(text, query string) string {
+	terms := make(map[string]bool)
+	for _, t := range search.Terms(query) {
+		terms[t] = true
+	}
+	var b strings.Builder
+	word := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }
+	for len(text) > 0 {
+		i := strings.IndexFunc(text, func(r rune) bool { return !word(r) })
+		if i == 0 {
+			// a run of separators
+			i = strings.IndexFunc(text, word)
+			if i < 0 {
+				i = len(text)
+			}
+			b.WriteString(html.EscapeString(text[:i]))
+			text = text[i:]
+			continue
+		}
+		if i < 0 {
+			i = len(text)
+		}
+		if w := text[:i]; terms[strings.ToLower(w)] {
+			b.WriteString("<b>" + html.EscapeString(w) + "</b>")
+		} else {
+			b.WriteString(html.EscapeString(w))
+		}
+		text = text[i:]
+	}
+	return b.String()
+}
+
+// searchHandler serves the search page, results are also available as json with format=json
+func (z *Config) searchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/search" {
+		http.NotFound(w, r)
+		return
+	}
+	if z.index == nil {
+		http.Error(w, "search is not configured", http.StatusNotFound)
+		return
+	}
+	z.loadIndex()
+	query := r.FormValue("q")
+	results := searchResults(z.index.Search(query, searchLimit))
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(results); err != nil {
+			z.logger.Print(err)
+		}
+		return
+	}
+
+	mw := mustWriter{w: w}
+	w.Header().Set("Content-Type", "text/html")
+	mw.Write([]byte("<head><style>table, table th,table tr, table td{border-collapse: collapse;border:1px solid #000000;padding:3px}</style></head><body>"))
+	mw.Write([]byte(fmt.Sprintf("<form action=\"/search\"><input name=\"q\" size=\"50\" value=\"%s\" autofocus> <input type=\"submit\" value=\"Search\"></form>",
+		html.EscapeString(query))))
+	switch {
+	case query == "":
+		mw.Write([]byte(fmt.Sprintf("Search the transcripts and chat of %d archived recordings", z.index.Len())))
+	case len(results) == 0:
+		mw.Write([]byte("No matches"))
+	default:
+		mw.Write([]byte("<table><tr><th>Meeting</th><th>Date</th><th>At</th><th>Match</th></tr>"))
+		for _, res := range results {
+			match := highlight(res.Snippet, query)
+			if res.Speaker != "" {
+				match = "<i>" + highlight(res.Speaker, query) + "</i>: " + match
+			}
+			mw.Write([]byte(fmt.Sprintf("<tr><td>%s</td><td>%s</td><td><a href=\"%s\">%s</a> %s</td><td>%s</td></tr>",
+				html.EscapeString(res.Topic), res.Start.Format("2006-01-02 15:04"), html.EscapeString(res.Link), res.At, res.Kind, match)))
+		}
+		mw.Write([]byte("</table>"))
+	}
+	mw.Write([]byte("</body>"))
+}
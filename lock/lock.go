@@ -0,0 +1,183 @@
+// Package lock provides a file lock to keep separate zat processes, eg a cron job and a server,
+// from archiving at the same time.
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// PollInterval is how often Acquire retries while waiting for the lock
+var PollInterval = time.Second
+
+// ErrLocked is matched by errors returned when the lock is held by another process.
+var ErrLocked = errors.New("lock held by another process")
+
+// errWouldBlock is returned by the platform lockFile when the lock is already held
+var errWouldBlock = errors.New("would block")
+
+// Holder describes the process holding a lock.
+type Holder struct {
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Command  string    `json:"command"`
+	Acquired time.Time `json:"acquired"`
+}
+
+func (h Holder) String() string {
+	return fmt.Sprintf("pid %d on %s since %s", h.PID, h.Hostname, h.Acquired.Format(time.RFC3339))
+}
+
+// Alive reports whether the holder is still running, holders on other hosts are assumed to be.
+func (h Holder) Alive() bool {
+	if hostname, _ := os.Hostname(); hostname != h.Hostname {
+		return true
+	}
+	return processAlive(h.PID)
+}
+
+// HeldError is returned when the lock could not be acquired.
+type HeldError struct {
+	Path string
+	// Holder is nil when the holder could not be determined
+	Holder *Holder
+}
+
+func (e *HeldError) Error() string {
+	if e.Holder == nil {
+		return fmt.Sprintf("%s is locked by another process", e.Path)
+	}
+	return fmt.Sprintf("%s is locked by %s", e.Path, e.Holder)
+}
+
+func (e *HeldError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// Lock is a held lock.
+type Lock struct {
+	f *os.File
+	// Stale is set when a previous holder exited without releasing the lock
+	Stale *Holder
+}
+
+// Acquire takes the lock at path, waiting up to wait for another process to release it.
+func Acquire(ctx context.Context, path string, wait time.Duration) (*Lock, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		l, err := tryAcquire(path)
+		if err == nil || !errors.Is(err, ErrLocked) || !time.Now().Before(deadline) {
+			return l, err
+		}
+		t := time.NewTimer(PollInterval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		case <-t.C:
+		}
+	}
+}
+
+func tryAcquire(path string) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("while opening lock file: %w", err)
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if err == errWouldBlock {
+			holder, _ := ReadHolder(path)
+			return nil, &HeldError{Path: path, Holder: holder}
+		}
+		return nil, fmt.Errorf("while locking %s: %w", path, err)
+	}
+
+	l := &Lock{f: f}
+	// a holder recorded in an unlocked file did not release it, eg it crashed
+	if stale, err := readHolder(f); err == nil && stale != nil {
+		l.Stale = stale
+	}
+	hostname, _ := os.Hostname()
+	holder := Holder{
+		PID:      os.Getpid(),
+		Hostname: hostname,
+		Command:  strings.Join(os.Args, " "),
+		Acquired: time.Now(),
+	}
+	if err := l.write(&holder); err != nil {
+		l.Release()
+		return nil, fmt.Errorf("while recording lock holder: %w", err)
+	}
+	return l, nil
+}
+
+// write replaces the holder recorded in the lock file, nil clears it
+func (l *Lock) write(holder *Holder) error {
+	if err := l.f.Truncate(0); err != nil {
+		return err
+	}
+	if holder != nil {
+		b, err := json.Marshal(holder)
+		if err != nil {
+			return err
+		}
+		if _, err := l.f.WriteAt(b, 0); err != nil {
+			return err
+		}
+	}
+	return l.f.Sync()
+}
+
+// Release clears the holder and unlocks. The lock file is left in place,
+// removing it would race with processes that have it open.
+func (l *Lock) Release() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	err := l.write(nil)
+	if uerr := unlockFile(l.f); err == nil {
+		err = uerr
+	}
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
+
+// ReadHolder reports the holder recorded at path, nil when unlocked.
+// Holders that are no longer alive may be reported, see Holder.Alive.
+func ReadHolder(path string) (*Holder, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	return readHolder(f)
+}
+
+func readHolder(r io.ReaderAt) (*Holder, error) {
+	b, err := ioutil.ReadAll(io.NewSectionReader(r, 0, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(b))) == 0 {
+		return nil, nil
+	}
+	var holder Holder
+	if err := json.Unmarshal(b, &holder); err != nil {
+		return nil, fmt.Errorf("while reading lock holder: %w", err)
+	}
+	return &holder, nil
+}
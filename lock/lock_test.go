@@ -0,0 +1,93 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tempLockPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "zat")
+	require.NoError(t, err)
+	return filepath.Join(dir, "zat.lock"), func() { os.RemoveAll(dir) }
+}
+
+func TestAcquire(t *testing.T) {
+	path, cleanup := tempLockPath(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	l, err := Acquire(ctx, path, 0)
+	require.NoError(t, err)
+	assert.Nil(t, l.Stale)
+
+	holder, err := ReadHolder(path)
+	require.NoError(t, err)
+	require.NotNil(t, holder)
+	assert.Equal(t, os.Getpid(), holder.PID)
+	assert.True(t, holder.Alive())
+
+	// a second open file description conflicts, as another process would
+	_, err = Acquire(ctx, path, 0)
+	assert.True(t, errors.Is(err, ErrLocked), err)
+	var held *HeldError
+	require.True(t, errors.As(err, &held))
+	assert.Equal(t, os.Getpid(), held.Holder.PID)
+
+	require.NoError(t, l.Release())
+	holder, err = ReadHolder(path)
+	require.NoError(t, err)
+	assert.Nil(t, holder)
+
+	l, err = Acquire(ctx, path, 0)
+	require.NoError(t, err)
+	require.NoError(t, l.Release())
+	// releasing twice is harmless
+	require.NoError(t, l.Release())
+}
+
+func TestAcquireWait(t *testing.T) {
+	defer func(interval time.Duration) { PollInterval = interval }(PollInterval)
+	PollInterval = 10 * time.Millisecond
+
+	path, cleanup := tempLockPath(t)
+	defer cleanup()
+	ctx := context.Background()
+	l, err := Acquire(ctx, path, 0)
+	require.NoError(t, err)
+
+	_, err = Acquire(ctx, path, 30*time.Millisecond)
+	assert.True(t, errors.Is(err, ErrLocked), err)
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		l.Release()
+	}()
+	waited, err := Acquire(ctx, path, 5*time.Second)
+	require.NoError(t, err)
+	require.NoError(t, waited.Release())
+}
+
+func TestAcquireStale(t *testing.T) {
+	path, cleanup := tempLockPath(t)
+	defer cleanup()
+	stale := `{"pid":999999999,"hostname":"elsewhere","command":"zat","acquired":"2020-04-01T00:00:00Z"}`
+	require.NoError(t, ioutil.WriteFile(path, []byte(stale), 0600))
+
+	holder, err := ReadHolder(path)
+	require.NoError(t, err)
+	assert.Equal(t, "elsewhere", holder.Hostname)
+
+	l, err := Acquire(context.Background(), path, 0)
+	require.NoError(t, err)
+	defer l.Release()
+	require.NotNil(t, l.Stale)
+	assert.Equal(t, 999999999, l.Stale.PID)
+}
@@ -3,14 +3,18 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"flag"
+	"errors"
 	"fmt"
+	"html"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,12 +24,14 @@ import (
 	"go.elastic.co/apm"
 	"go.elastic.co/apm/module/apmhttp"
 	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
 	"gopkg.in/yaml.v2"
 
-	"github.com/graphaelli/zat/cmd"
 	"github.com/graphaelli/zat/google"
-	"github.com/graphaelli/zat/slack"
+	"github.com/graphaelli/zat/lock"
+	"github.com/graphaelli/zat/search"
 	"github.com/graphaelli/zat/zoom"
+	"github.com/graphaelli/zat/zoom/chatlog"
 )
 
 // mustWriter is an io.Writer that panics on Write error
@@ -40,13 +46,14 @@ func (m mustWriter) Write(b []byte) {
 	}
 }
 
-func NewMux(zat *Config, params runParams) *http.ServeMux {
+// NewMux serves the web interface, restricted by auth when not nil
+func NewMux(zat *Config, params runParams, auth *webAuth) *http.ServeMux {
 	logger := zat.logger
 	googleClient := zat.googleClient
 	zoomClient := zat.zoomClient
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/", auth.require(roleViewer, func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" {
 			http.NotFound(w, r)
 			return
@@ -56,6 +63,10 @@ func NewMux(zat *Config, params runParams) *http.ServeMux {
 		mw.Write([]byte("<meta http-equiv=\"refresh\" content=\"10\"/>"))
 		mw.Write([]byte("<head><style>table, table th,table tr, table td{border-collapse: collapse;border:1px solid #000000;padding:3px}</style></head><body>"))
 
+		if u := webUserFromContext(r.Context()); u != nil {
+			mw.Write([]byte(fmt.Sprintf("%s (%s) <a href=\"/auth/logout\">logout</a><br>", html.EscapeString(u.Email), u.Role)))
+		}
+
 		mw.Write([]byte("<br>Google: "))
 		if !googleClient.HasCreds() {
 			mw.Write([]byte("<a href=\"/google\">login</a>"))
@@ -64,6 +75,15 @@ func NewMux(zat *Config, params runParams) *http.ServeMux {
 		} else {
 			mw.Write([]byte("<span style=\"color:green\">OK</span>"))
 		}
+		if email, subject := googleClient.ServiceAccount(); email != "" {
+			mw.Write([]byte(" as service account " + html.EscapeString(email)))
+			if subject != "" {
+				mw.Write([]byte(" impersonating " + html.EscapeString(subject)))
+			}
+		}
+		if _, err := googleClient.TokenStatus(); err != nil {
+			mw.Write([]byte(fmt.Sprintf(" <span style=\"color:red\">token refresh failed: %s</span>", html.EscapeString(err.Error()))))
+		}
 
 		mw.Write([]byte("<br>Zoom: "))
 		if !zoomClient.HasCreds() {
@@ -73,15 +93,37 @@ func NewMux(zat *Config, params runParams) *http.ServeMux {
 		} else {
 			mw.Write([]byte("<span style=\"color:green\">OK</span>"))
 		}
+		if _, err := zoomClient.TokenStatus(); err != nil {
+			mw.Write([]byte(fmt.Sprintf(" <span style=\"color:red\">token refresh failed: %s</span>", html.EscapeString(err.Error()))))
+		}
 
-		if archIsRunning {
+		archIsRunningMu.Lock()
+		running := archIsRunning
+		archIsRunningMu.Unlock()
+		var holder *lock.Holder
+		if !running && zat.lockPath != "" {
+			var err error
+			if holder, err = lock.ReadHolder(zat.lockPath); err != nil {
+				logger.Printf("failed to read %s: %s", zat.lockPath, err)
+			}
+		}
+		if running {
 			mw.Write([]byte("<br/>Archiving...</a>"))
+		} else if holder != nil && holder.Alive() {
+			mw.Write([]byte(fmt.Sprintf("<br/>Archiving in another process: %s", html.EscapeString(holder.String()))))
 		} else if googleClient.HasCreds() && zoomClient.HasCreds() {
-			mw.Write([]byte("<br/><a href=\"/archive\">Archive Now</a>"))
+			if holder != nil {
+				mw.Write([]byte(fmt.Sprintf("<br/>Stale lock left by %s", html.EscapeString(holder.String()))))
+			}
+			mw.Write([]byte("<form method=\"post\" action=\"/archive\"><button>Archive Now</button></form>"))
 		} else {
 			mw.Write([]byte("<br/>Login, to be able to archive"))
 		}
 
+		if zat.index != nil {
+			mw.Write([]byte("<br/><a href=\"/search\">Search transcripts and chat</a>"))
+		}
+
 		if len(archDetails) > 0 {
 			mw.Write([]byte("<br/><br/><table><tr><th>Name</th><th>Date</th><th>Files</th><th>Status</th></th>"))
 			for i := 0; i < len(archDetails); i++ {
@@ -91,20 +133,57 @@ func NewMux(zat *Config, params runParams) *http.ServeMux {
 			}
 			mw.Write([]byte("</table>"))
 		}
+		if zat.pendingPath != "" {
+			pending, err := loadPending(zat.pendingPath)
+			if err != nil {
+				logger.Printf("failed to load pending recordings from %s: %s", zat.pendingPath, err)
+			}
+			if meetings := pending.list(); len(meetings) > 0 {
+				mw.Write([]byte("<br/>Waiting on zoom to process:<ul>"))
+				for _, m := range meetings {
+					var files []string
+					for _, f := range m.Files {
+						files = append(files, strings.ToLower(f.FileType))
+					}
+					mw.Write([]byte(fmt.Sprintf("<li>%s %s: %s</li>", html.EscapeString(m.Topic),
+						m.StartTime.Format("2006-01-02 15:04"), html.EscapeString(strings.Join(files, ", ")))))
+				}
+				mw.Write([]byte("</ul>"))
+			}
+		}
+		if podcasts := zat.podcasts(); len(podcasts) > 0 {
+			mw.Write([]byte("<br/>Podcasts:<ul>"))
+			for _, id := range podcasts {
+				action := zat.copies[id]
+				mw.Write([]byte(fmt.Sprintf("<li><a href=\"%s\">%s</a></li>",
+					html.EscapeString(podcastURL(zat.podcastBase(r), action.Podcast, id, "")), html.EscapeString(action.Name))))
+			}
+			mw.Write([]byte("</ul>"))
+		}
 		mw.Write([]byte("</body>"))
-	})
+	}))
 
-	mux.HandleFunc("/archive", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/archive", auth.require(roleOperator, func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/archive" {
 			http.NotFound(w, r)
 			return
 		}
+		// archiving is started by a form, never a link another site could send a signed in user to
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "archiving requires a POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if !sameOrigin(r) {
+			http.Error(w, "cross-site request refused", http.StatusForbidden)
+			return
+		}
 
 		go doRun(zat, params)
 		http.Redirect(w, r, "/", http.StatusSeeOther)
-	})
+	}))
 
-	mux.HandleFunc("/google", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/google", auth.require(roleOperator, func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/google" {
 			http.NotFound(w, r)
 			return
@@ -131,9 +210,9 @@ func NewMux(zat *Config, params runParams) *http.ServeMux {
 		if err := json.NewEncoder(w).Encode(files); err != nil {
 			logger.Print(err)
 		}
-	})
+	}))
 
-	mux.HandleFunc("/zoom", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/zoom", auth.require(roleOperator, func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/zoom" {
 			http.NotFound(w, r)
 			return
@@ -158,10 +237,14 @@ func NewMux(zat *Config, params runParams) *http.ServeMux {
 		if err := json.NewEncoder(w).Encode(recordings); err != nil {
 			logger.Print(err)
 		}
-	})
+	}))
+
+	mux.HandleFunc("/podcast/", zat.podcastHandler(auth))
+	mux.HandleFunc("/search", auth.require(roleViewer, zat.searchHandler))
 
-	mux.HandleFunc("/oauth/google", googleClient.OauthHandler())
-	mux.HandleFunc("/oauth/zoom", zoomClient.OauthHandler())
+	mux.HandleFunc("/oauth/google", auth.require(roleOperator, googleClient.OauthHandler()))
+	mux.HandleFunc("/oauth/zoom", auth.require(roleOperator, zoomClient.OauthHandler()))
+	auth.register(mux)
 	return mux
 }
 
@@ -170,11 +253,83 @@ type Directive struct {
 	Google string `json:"google"`
 	Zoom   string `json:"zoom"`
 	Slack  string `json:"slack"`
+
+	// Share is applied to meeting folders as they are created
+	Share []ShareRule `json:"share,omitempty"`
+	// CopyRequiresWriterPermission disables download, print and copy of uploaded files for readers and commenters
+	CopyRequiresWriterPermission bool `json:"copy_requires_writer_permission,omitempty" yaml:"copy_requires_writer_permission"`
+	// Participants lists the attendance report formats to archive alongside recordings: csv, json
+	Participants []string `json:"participants,omitempty"`
+	// Transcripts lists conversions of vtt transcripts and closed captions to archive: doc, txt, md
+	Transcripts []string `json:"transcripts,omitempty"`
+	// Chat lists renderings of the chat log to archive: doc, html
+	Chat []string `json:"chat,omitempty"`
+	// Readme lists human readable summaries of the meeting to keep alongside meeting.json: md, doc
+	Readme []string `json:"readme,omitempty"`
+	// Podcast serves a podcast feed of the audio recordings archived
+	Podcast *Podcast `json:"podcast,omitempty"`
+	// Hook runs a command on each recording downloaded, before it is archived
+	Hook *Hook `json:"hook,omitempty"`
+	// Transcode re-encodes mp4 recordings with ffmpeg, extracts their audio and keeps thumbnails
+	Transcode *Transcode `json:"transcode,omitempty"`
+	// Trim cuts dead air from the start and end of recordings, and transcripts to match
+	Trim *Trim `json:"trim,omitempty"`
+	// ChatLinks replies to the slack notification with links shared in the chat
+	ChatLinks bool `json:"chat_links,omitempty" yaml:"chat_links"`
+	// SlackMessage is a text/template for the slack notification, with notification data
+	SlackMessage string `json:"slack_message,omitempty" yaml:"slack_message"`
+
+	// Types lists the file types to archive, overriding -t
+	Types []string `json:"types,omitempty"`
+	// MinDuration is the shortest meeting or recording archived, overriding -min-duration
+	MinDuration *time.Duration `json:"min_duration,omitempty" yaml:"min_duration"`
+	// MaxAge skips meetings that started longer ago
+	MaxAge time.Duration `json:"max_age,omitempty" yaml:"max_age"`
+	// ExcludeRecordingTypes lists recording types not to archive, eg gallery_view
+	ExcludeRecordingTypes []string `json:"exclude_recording_types,omitempty" yaml:"exclude_recording_types"`
+}
+
+// minDuration is the shortest meeting or recording archived
+func (d Directive) minDuration(params runParams) time.Duration {
+	if d.MinDuration != nil {
+		return *d.MinDuration
+	}
+	return time.Duration(params.minDuration) * time.Minute
+}
+
+// excluded reports whether f is filtered out by its file type or recording type
+func (d Directive) excluded(f zoom.RecordingFile, params runParams) bool {
+	types := d.Types
+	if len(types) == 0 && params.uploadFilter != "" {
+		types = strings.Split(params.uploadFilter, ",")
+	}
+	if len(types) > 0 && !containsFold(types, f.FileType) {
+		return true
+	}
+	return f.RecordingType != "" && containsFold(d.ExcludeRecordingTypes, f.RecordingType)
+}
+
+// tooOld reports whether meeting started longer than MaxAge ago
+func (d Directive) tooOld(meeting zoom.Meeting, now time.Time) bool {
+	return d.MaxAge > 0 && meeting.StartTime.Before(now.Add(-d.MaxAge))
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(strings.TrimSpace(v), s) {
+			return true
+		}
+	}
+	return false
 }
 
 // use invalid json to avoid conflict
 var skipDirective = Directive{Name: "{skip"}
 
+func (d Directive) skip() bool {
+	return d.Name == skipDirective.Name
+}
+
 // zoom meeting -> action
 type Config struct {
 	logger       *log.Logger
@@ -182,6 +337,26 @@ type Config struct {
 	googleClient *google.Client
 	slackClient  *slackapi.Client
 	zoomClient   *zoom.Client
+
+	// lockPath, when set, is locked during Run to keep other processes from archiving concurrently
+	lockPath string
+	lockWait time.Duration
+	// pendingPath, when set, persists recordings still processing to recheck on later runs
+	pendingPath string
+	pending     *pendingRecordings
+	// foldersPath, when set, persists the folders path destinations resolved to
+	foldersPath string
+	folders     *folderCache
+	// publicURL is where zat is reached, for links in podcast feeds written to drive
+	publicURL string
+	// index, when set, is the search index of archived transcripts and chat, persisted at indexPath
+	indexPath string
+	index     *search.Index
+	// preRun and postRun are shell commands run before and after archiving
+	preRun  string
+	postRun string
+	// ffmpeg is the ffmpeg binary used to transcode recordings
+	ffmpeg string
 }
 
 func NewConfigFromFile(logger *log.Logger, path string, googleClient *google.Client, zoomClient *zoom.Client,
@@ -212,6 +387,62 @@ func NewConfigFromReader(logger *log.Logger, r io.Reader, googleClient *google.C
 	}
 	c := map[int64]Directive{}
 	for _, d := range directives {
+		for _, rule := range d.Share {
+			if err := rule.validate(); err != nil {
+				return nil, fmt.Errorf("invalid share for %q: %w", d.Name, err)
+			}
+		}
+		for _, format := range d.Participants {
+			if format != participantsCSV && format != participantsJSON {
+				return nil, fmt.Errorf("invalid participants format for %q: %q", d.Name, format)
+			}
+		}
+		for _, format := range d.Transcripts {
+			if format != transcriptDoc && format != transcriptText && format != transcriptMarkdown {
+				return nil, fmt.Errorf("invalid transcript format for %q: %q", d.Name, format)
+			}
+		}
+		for _, format := range d.Chat {
+			if format != chatDoc && format != chatHTML {
+				return nil, fmt.Errorf("invalid chat format for %q: %q", d.Name, format)
+			}
+		}
+		for _, format := range d.Readme {
+			if format != readmeMarkdown && format != readmeDoc {
+				return nil, fmt.Errorf("invalid readme format for %q: %q", d.Name, format)
+			}
+		}
+		if d.Podcast != nil {
+			if err := d.Podcast.validate(); err != nil {
+				return nil, fmt.Errorf("invalid podcast for %q: %w", d.Name, err)
+			}
+		}
+		if d.Hook != nil {
+			if err := d.Hook.validate(); err != nil {
+				return nil, fmt.Errorf("invalid hook for %q: %w", d.Name, err)
+			}
+		}
+		if d.Transcode != nil {
+			if err := d.Transcode.validate(); err != nil {
+				return nil, fmt.Errorf("invalid transcode for %q: %w", d.Name, err)
+			}
+		}
+		if d.Trim != nil {
+			if err := d.Trim.validate(); err != nil {
+				return nil, fmt.Errorf("invalid trim for %q: %w", d.Name, err)
+			}
+		}
+		if (d.MinDuration != nil && *d.MinDuration < 0) || d.MaxAge < 0 {
+			return nil, fmt.Errorf("invalid duration for %q: must not be negative", d.Name)
+		}
+		if d.Google != "" {
+			if _, err := parseDestination(d.Google); err != nil {
+				return nil, fmt.Errorf("invalid google destination for %q: %w", d.Name, err)
+			}
+		}
+		if _, err := parseSlackMessage(d.SlackMessage); err != nil {
+			return nil, fmt.Errorf("invalid slack message for %q: %w", d.Name, err)
+		}
 		key, err := strconv.ParseInt(strings.ReplaceAll(d.Zoom, "-", ""), 10, 64)
 		if err != nil {
 			return nil, err
@@ -229,6 +460,7 @@ func NewConfigFromReader(logger *log.Logger, r io.Reader, googleClient *google.C
 		googleClient: googleClient,
 		slackClient:  slackClient,
 		zoomClient:   zoomClient,
+		folders:      newFolderCache(""),
 	}, nil
 }
 
@@ -266,36 +498,138 @@ func recordingFileName(meeting zoom.Meeting, recording zoom.RecordingFile) strin
 	return baseName + "." + ext
 }
 
-func mkdir(ctx context.Context, gdrive *drive.Service, parent *drive.File, folder string) (*drive.File, error, bool) {
+// mkdir finds or creates folder in parent. Folders tagged with props are preferred,
+// so renamed folders are still found, falling back to matching by name.
+func mkdir(ctx context.Context, gdrive *google.Drive, parent *drive.File, folder string, props map[string]string) (*drive.File, error, bool) {
 	span, ctx := apm.StartSpan(ctx, "mkdir", "app")
 	defer span.End()
 
 	// maybe no need to check if it exists first, can just "mkdir -p" no matter what? for now look to enable dryrun
 	// exact match 1 folder
-	query := fmt.Sprintf("mimeType=%q and %q in parents and name=%q and trashed=false", google.MimeTypeFolder, parent.Id, folder)
-	if result, err := gdrive.Files.List().Context(ctx).SupportsTeamDrives(true).IncludeTeamDriveItems(true).Q(query).Do(); err != nil {
-		return nil, err, false
-	} else {
-		fileCount := len(result.Files)
-		if fileCount > 1 {
-			return nil, fmt.Errorf("%d files found: %#v, expected 0 or 1", fileCount, result.Files), false
-		} else if fileCount == 1 {
+	queries := []string{fmt.Sprintf("mimeType=%q and %q in parents and name=%q and trashed=false", google.MimeTypeFolder, parent.Id, folder)}
+	if len(props) > 0 {
+		queries = append([]string{fmt.Sprintf("mimeType=%q and %q in parents and trashed=false and %s",
+			google.MimeTypeFolder, parent.Id, propertiesQuery(props))}, queries...)
+	}
+	for _, query := range queries {
+		result, err := gdrive.ListFiles(ctx, query, "", fileFields)
+		if err != nil {
+			return nil, err, false
+		}
+		if len(result.Files) > 0 {
+			// duplicates, eg from a create that failed after drive made the folder, settle on the oldest
+			sort.Slice(result.Files, func(i, j int) bool {
+				a, b := result.Files[i], result.Files[j]
+				return a.CreatedTime < b.CreatedTime || (a.CreatedTime == b.CreatedTime && a.Id < b.Id)
+			})
 			return result.Files[0], nil, false
 		}
 	}
 
 	// folder doesn't exist when we checked, create it.  no real problem if it was already created
-	if result, err := gdrive.Files.Create(&drive.File{
-		Name:     folder,
-		MimeType: google.MimeTypeFolder,
-		Parents:  []string{parent.Id},
-	}).Context(ctx).SupportsAllDrives(true).Do(); err != nil {
+	if result, err := gdrive.CreateFile(ctx, &drive.File{
+		Name:          folder,
+		MimeType:      google.MimeTypeFolder,
+		Parents:       []string{parent.Id},
+		AppProperties: props,
+	}, nil); err != nil {
 		return nil, err, false
 	} else {
+		// the created file is returned without its properties
+		result.AppProperties = props
 		return result, nil, true
 	}
 }
 
+// uploadBytes creates file in drive with body as its content, tagged files are tagged with its checksum too
+func uploadBytes(ctx context.Context, gdrive *google.Drive, file *drive.File, body []byte, contentType string) (*drive.File, error) {
+	if file.AppProperties != nil {
+		file.AppProperties[propChecksum] = checksum(body)
+	}
+	var opts []googleapi.MediaOption
+	if contentType != "" {
+		opts = append(opts, googleapi.ContentType(contentType))
+	}
+	return gdrive.CreateFile(ctx, file, bytes.NewReader(body), opts...)
+}
+
+// uploadRecording streams body to a new file, tagging it with the checksum of the content once uploaded.
+// The recording is archived even when tagging fails, it is only missing its checksum.
+func (z *Config) uploadRecording(ctx context.Context, gdrive *google.Drive, file *drive.File, body io.Reader) error {
+	h := sha256.New()
+	created, err := gdrive.CreateFile(ctx, file, io.TeeReader(body, h))
+	if err != nil {
+		return err
+	}
+	if _, err := gdrive.UpdateFile(ctx, created.Id, &drive.File{
+		AppProperties: map[string]string{propChecksum: hex.EncodeToString(h.Sum(nil))},
+	}); err != nil {
+		z.logger.Printf("failed to tag %q with its checksum: %s", file.Name, err)
+		apm.CaptureError(ctx, err).Send()
+	}
+	return nil
+}
+
+// archiveFile downloads the recording file f of meeting and archives it, unless indexOnly, indexing what was downloaded.
+// Any copies spooled to disk along the way are removed before it returns.
+func (z *Config) archiveFile(ctx context.Context, gdrive *google.Drive, folder *drive.File, meeting zoom.Meeting,
+	f zoom.RecordingFile, name string, action Directive, exists, indexOnly bool, conversions []string) ([]chatlog.Link, error) {
+	download, err := z.zoomClient.Download(ctx, f, meeting.DownloadOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	defer download.Close()
+	var body io.Reader = download
+	if action.Hook.hooks(f) {
+		hooked, err := z.hookRecording(ctx, action, meeting, folder, f, name, download)
+		if errors.Is(err, errHookSkip) {
+			return nil, err
+		} else if err != nil {
+			return nil, fmt.Errorf("directive %q: while running hook on %s: %w", action.Name, name, err)
+		}
+		defer hooked.Close()
+		body = hooked
+	}
+	var content bytes.Buffer
+	if z.indexes(f) {
+		body = io.TeeReader(body, &content)
+	}
+	// the index links to zoom's recording, so it is of the untrimmed transcript
+	if !indexOnly && action.Trim.trims(f) {
+		trimmed, err := z.trimRecording(ctx, gdrive, folder, action, f, name, body)
+		if err != nil {
+			return nil, fmt.Errorf("directive %q: while trimming %s: %w", action.Name, name, err)
+		}
+		defer trimmed.Close()
+		body = trimmed
+	}
+
+	var links []chatlog.Link
+	if indexOnly {
+		_, err = io.Copy(ioutil.Discard, body)
+	} else if isChat(f) && (len(conversions) > 0 || action.ChatLinks) {
+		links, err = z.archiveChat(ctx, gdrive, folder, meeting, f, name, body, !exists, conversions, action)
+	} else if action.Transcode.transcodes(f) {
+		err = z.archiveTranscoded(ctx, gdrive, folder, meeting, f, name, body, !exists, conversions, action)
+	} else if len(conversions) > 0 {
+		err = z.archiveTranscript(ctx, gdrive, folder, meeting, f, name, body, !exists, conversions, action)
+	} else {
+		err = z.uploadRecording(ctx, gdrive, &drive.File{
+			Name:                         name,
+			Parents:                      []string{folder.Id},
+			CopyRequiresWriterPermission: action.CopyRequiresWriterPermission,
+			AppProperties:                fileProperties(meeting, f, ""),
+		}, body)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("directive %q: while uploading recording %s: %w", action.Name, zoom.RedactURL(f.DownloadURL), err)
+	}
+	if z.indexes(f) {
+		z.indexRecording(meeting, f, folder, content.Bytes())
+	}
+	return links, nil
+}
+
 func (z *Config) Archive(ctx context.Context, meeting zoom.Meeting, params runParams) error {
 	span, ctx := apm.StartSpan(ctx, "Archive", "app")
 	defer span.End()
@@ -308,37 +642,43 @@ func (z *Config) Archive(ctx context.Context, meeting zoom.Meeting, params runPa
 	archDetails = append(archDetails, &curArchMeeting)
 
 	// check what is already uploaded for this meeting
-	gdrive, err := z.googleClient.Service(ctx)
+	gdrive, err := z.googleClient.Drive(ctx)
 	if err != nil {
 		return fmt.Errorf("while creating gdrive client: %w", err)
 	}
 	action := z.copies[meeting.ID]
-	if action == skipDirective {
+	if action.skip() {
 		curArchMeeting.status = "error"
 		return fmt.Errorf("skipped mapping meeting %d %q", meeting.ID, meeting.Topic)
 	}
 	// parent folder of all meetings
-	parentFolderName := action.Google
-	if parentFolderName == "" {
+	if action.Google == "" {
 		curArchMeeting.status = "error"
 		return fmt.Errorf("no mapping found for meeting %d %q", meeting.ID, meeting.Topic)
 	}
 
-	parent, err := gdrive.Files.Get(parentFolderName).Context(ctx).SupportsAllDrives(true).Do()
+	parent, err := z.destinationFolder(ctx, gdrive, action)
 	if err != nil {
 		curArchMeeting.status = "error"
-		return fmt.Errorf("while finding parent of %q: %w", parentFolderName, err)
+		return fmt.Errorf("directive %q: while finding parent of %q: %w", action.Name, action.Google, err)
 	}
 
 	// parent folder for this meeting
-	meetingFolder, err, created := mkdir(ctx, gdrive, parent, meetingFolderName(meeting))
+	meetingFolder, err, created := mkdir(ctx, gdrive, parent, meetingFolderName(meeting), folderProperties(meeting))
 	if err != nil {
 		curArchMeeting.status = "error"
-		return fmt.Errorf("while finding/creating meeting folder: %w", err)
+		return fmt.Errorf("directive %q: while finding/creating meeting folder: %w", action.Name, err)
 	}
 	if created {
 		z.logger.Printf("created folder %s: https://drive.google.com/drive/folders/%s",
 			meetingFolder.Name, meetingFolder.Id)
+		if len(action.Share) > 0 {
+			// sharing is best effort, recordings are still archived
+			if err := z.shareFolder(ctx, gdrive, meetingFolder, meeting, action.Share); err != nil {
+				z.logger.Print(err)
+				apm.CaptureError(ctx, err).Send()
+			}
+		}
 	} else {
 		z.logger.Printf("using existing folder %s: https://drive.google.com/drive/folders/%s",
 			meetingFolder.Name, meetingFolder.Id)
@@ -347,48 +687,37 @@ func (z *Config) Archive(ctx context.Context, meeting zoom.Meeting, params runPa
 	curArchMeeting.googleDriveURL = "https://drive.google.com/drive/folders/" + meetingFolder.Id
 
 	// list folder for this meeting
-	alreadyUploaded := make(map[string]struct{})
-	nextPageToken := ""
-	for page := 0; page < 5; page++ {
-		call := gdrive.Files.List().
-			Context(ctx).
-			SupportsTeamDrives(true).
-			IncludeTeamDriveItems(true).
-			Q(fmt.Sprintf("%q in parents", meetingFolder.Id))
-		if nextPageToken != "" {
-			call = call.PageToken(nextPageToken)
-		}
-		meetingFiles, err := call.Do()
-		if err != nil {
-			curArchMeeting.status = "error"
-			return fmt.Errorf("while listing meeting folder: %w", err)
-		}
-		for _, f := range meetingFiles.Files {
-			alreadyUploaded[f.Name] = struct{}{}
-		}
-		if meetingFiles.NextPageToken == "" {
-			break
-		}
-		nextPageToken = meetingFiles.NextPageToken
+	alreadyUploaded, err := listArchived(ctx, gdrive, meetingFolder, meeting)
+	if err != nil {
+		curArchMeeting.status = "error"
+		return fmt.Errorf("directive %q: while listing meeting folder: %w", action.Name, err)
 	}
 
 	// download & upload serially for now
 	z.logger.Printf("archiving meeting %d to %s (https://drive.google.com/drive/folders/%s)",
 		meeting.ID, meetingFolder.Name, meetingFolder.Id)
 	notifyUpload := false
+	// archivedFiles records whether meeting.json is out of date
+	archivedFiles := false
+	var chatLinks []chatlog.Link
 
-	exclude := func(string) bool { return false }
-	if params.uploadFilter != "" {
-		allowedFileTypes := map[string]bool{}
-		for _, uf := range strings.Split(params.uploadFilter, ",") {
-			allowedFileTypes[strings.ToLower(strings.TrimSpace(uf))] = true
-		}
-		exclude = func(fileType string) bool {
-			return !allowedFileTypes[strings.ToLower(fileType)]
-		}
+	exclude := func(f zoom.RecordingFile) bool {
+		return action.excluded(f, params)
+	}
+
+	files := meeting.RecordingFiles
+	if action.Trim != nil {
+		files = trimOrder(files)
 	}
+	var processing []zoom.RecordingFile
+	for _, f := range files {
+		// zoom serves an error page for files it hasn't finished processing, try again later
+		if isProcessing(f) && !exclude(f) {
+			z.logger.Printf("deferring %s recording of %q, zoom status %q", strings.ToLower(f.FileType), meeting.Topic, f.Status)
+			processing = append(processing, f)
+			continue
+		}
 
-	for _, f := range meeting.RecordingFiles {
 		//check if recording file duration is shorter than minimum
 		start, err := time.Parse(time.RFC3339, f.RecordingStart)
 		if err != nil {
@@ -401,80 +730,188 @@ func (z *Config) Archive(ctx context.Context, meeting zoom.Meeting, params runPa
 		}
 
 		if err == nil && err2 == nil {
-			duration := int(end.Sub(start).Minutes())
-			if duration < params.minDuration {
+			duration := end.Sub(start)
+			if duration < action.minDuration(params) {
 				curArchMeeting.status = "skipped - length"
-				z.logger.Printf("skipped %d minute recording at %s - %s", duration, start, end)
+				z.logger.Printf("skipped %s recording at %s - %s", duration, start, end)
 				continue
 			}
 		}
 
 		name := recordingFileName(meeting, f)
 
-		if exclude(f.FileType) {
-			z.logger.Printf("skipping upload %s, file type %q excluded", name, strings.ToLower(f.FileType))
+		if exclude(f) {
+			z.logger.Printf("skipping upload %s, file type %q or recording type %q excluded", name,
+				strings.ToLower(f.FileType), strings.ToLower(f.RecordingType))
 			continue
 		}
 
-		if _, exists := alreadyUploaded[name]; exists {
+		if action.Hook.skipped(meetingFolder, f) {
+			z.logger.Printf("skipping upload %s, skipped by hook on an earlier run", name)
+			continue
+		}
+
+		// transcripts, chat and transcoded mp4s are downloaded again if any conversion is missing
+		var conversions []string
+		switch {
+		case action.Transcode.transcodes(f):
+			for _, format := range action.Transcode.formats(meeting) {
+				if !alreadyUploaded.has(transcodedProperties(meeting, f, format), transcodedFileName(name, format)) {
+					conversions = append(conversions, format)
+				}
+			}
+		case isTranscript(f):
+			for _, format := range action.Transcripts {
+				if !alreadyUploaded.has(fileProperties(meeting, f, format), transcriptFileName(name, format)) {
+					conversions = append(conversions, format)
+				}
+			}
+		case isChat(f):
+			for _, format := range action.Chat {
+				if !alreadyUploaded.has(fileProperties(meeting, f, format), chatFileName(name, format)) {
+					conversions = append(conversions, format)
+				}
+			}
+		}
+
+		exists := alreadyUploaded.has(fileProperties(meeting, f, ""), name)
+		// transcripts and chat archived before the search index are downloaded again to index them
+		indexOnly := exists && len(conversions) == 0
+		if indexOnly && !z.needsIndex(meeting, f) {
 			curArchMeeting.status = "done"
 			curArchMeeting.fileNumber++
 			z.logger.Printf("skipping upload %s to %s/%s, already exists", name, parent.Name, meetingFolder.Name)
 			continue
 		}
-		z.logger.Printf("uploading %q to \"%s/%s\"", name, parent.Name, meetingFolder.Name)
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.DownloadURL, nil)
-		if err != nil {
-			curArchMeeting.status = "error"
-			return fmt.Errorf("while building recording download request %s: %w", f.DownloadURL, err)
+		if indexOnly {
+			z.logger.Printf("indexing %q, already archived to \"%s/%s\"", name, parent.Name, meetingFolder.Name)
+		} else {
+			z.logger.Printf("uploading %q to \"%s/%s\"", name, parent.Name, meetingFolder.Name)
 		}
-		v := req.URL.Query()
-		v.Add("access_token", z.zoomClient.AccessToken())
-		req.URL.RawQuery = v.Encode()
-		r, err := http.DefaultClient.Do(req)
-		if err != nil {
+		links, err := z.archiveFile(ctx, gdrive, meetingFolder, meeting, f, name, action, exists, indexOnly, conversions)
+		if errors.Is(err, errHookSkip) {
+			z.logger.Printf("skipping upload %s, %s", name, err)
+			z.recordHookSkip(ctx, gdrive, meetingFolder, action.Hook, f)
+			continue
+		} else if err != nil {
 			curArchMeeting.status = "error"
-			return fmt.Errorf("while downloading recording %s: %w", f.DownloadURL, err)
+			return err
+		}
+		chatLinks = append(chatLinks, links...)
+		if indexOnly {
+			curArchMeeting.status = "done"
+			curArchMeeting.fileNumber++
+			continue
+		}
+		curArchMeeting.fileNumber++
+		archivedFiles = true
+		z.logger.Printf("uploaded %q to %s/%s", name, parent.Name, meetingFolder.Name)
+		if isPreferred(f) {
+			notifyUpload = true
+		}
+	}
+	z.pending.set(meeting, processing)
+	for _, f := range processing {
+		if isPreferred(f) && notifyUpload {
+			z.logger.Printf("deferring slack notification for %q until its recordings are processed", meeting.Topic)
+			notifyUpload = false
 		}
-		defer r.Body.Close()
+	}
 
-		if r.StatusCode != http.StatusOK {
-			curArchMeeting.status = "error"
-			return fmt.Errorf("while downloading recording %s: download failed, got %d error: %#v",
-				f.DownloadURL, r.StatusCode, r)
+	// participants are only looked up once, when needed
+	var participants []zoom.Participant
+	var participantsErr error
+	participantsLoaded := false
+	loadParticipants := func() ([]zoom.Participant, error) {
+		if !participantsLoaded {
+			participants, participantsErr = z.meetingParticipants(ctx, meeting)
+			participantsLoaded = true
 		}
-		if contentType := r.Header.Get("content-type"); strings.HasPrefix(contentType, "text/html") {
-			curArchMeeting.status = "error"
-			return fmt.Errorf("while downloading recording %s: download failed, got %s content",
-				f.DownloadURL, contentType)
+		return participants, participantsErr
+	}
+
+	for _, format := range action.Participants {
+		name := participantsFileName(meeting, format)
+		if alreadyUploaded.has(participantsProperties(meeting, format), name) {
+			z.logger.Printf("skipping upload %s to %s/%s, already exists", name, parent.Name, meetingFolder.Name)
+			continue
 		}
-		_, err = gdrive.Files.Create(&drive.File{
-			Name:    name,
-			Parents: []string{meetingFolder.Id},
-		}).Context(ctx).Media(r.Body).SupportsAllDrives(true).Do()
+		// attendance is supplementary, don't fail the meeting over it
+		p, err := loadParticipants()
 		if err != nil {
-			curArchMeeting.status = "error"
-			return fmt.Errorf("while uploading recording %s: %w", f.DownloadURL, err)
+			z.logger.Printf("failed to list participants of %q: %s", meeting.Topic, err)
+			apm.CaptureError(ctx, err).Send()
+			break
 		}
-		curArchMeeting.fileNumber++
+		report, err := participantsReport(format, p)
+		if err != nil {
+			z.logger.Printf("failed to create participants report %s: %s", name, err)
+			continue
+		}
+		if _, err := uploadBytes(ctx, gdrive, &drive.File{
+			Name:                         name,
+			Parents:                      []string{meetingFolder.Id},
+			CopyRequiresWriterPermission: action.CopyRequiresWriterPermission,
+			AppProperties:                participantsProperties(meeting, format),
+		}, report, ""); err != nil {
+			z.logger.Printf("failed to upload participants report %s: %s", name, err)
+			apm.CaptureError(ctx, err).Send()
+			continue
+		}
+		archivedFiles = true
 		z.logger.Printf("uploaded %q to %s/%s", name, parent.Name, meetingFolder.Name)
-		if strings.ToLower(f.FileType) == "mp4" {
-			notifyUpload = true
+	}
+
+	// metadata is supplementary too, it's written again as later files arrive
+	if archivedFiles || !hasSidecars(alreadyUploaded, meeting, action) {
+		if err := z.archiveMetadata(ctx, gdrive, meetingFolder, meeting, action); err != nil {
+			z.logger.Printf("failed to archive metadata of %q: %s", meeting.Topic, err)
+			apm.CaptureError(ctx, err).Send()
+		}
+	}
+	if archivedFiles && action.Podcast != nil && action.Podcast.Drive {
+		if err := z.archivePodcast(ctx, gdrive, parent, meeting.ID, action); err != nil {
+			z.logger.Printf("failed to archive podcast feed of %q: %s", action.Name, err)
+			apm.CaptureError(ctx, err).Send()
 		}
 	}
+
 	if notifyUpload && action.Slack != "" && z.slackClient != nil {
 		slackSpan, ctx := apm.StartSpan(ctx, "slack", "app")
-		body := fmt.Sprintf("%s recording now available: https://drive.google.com/drive/folders/%s", meeting.Topic, meetingFolder.Id)
-		channel, _, text, err := z.slackClient.SendMessageContext(ctx, action.Slack, slackapi.MsgOptionText(body, true))
+		n := notification{
+			Meeting:   meeting,
+			FolderURL: "https://drive.google.com/drive/folders/" + meetingFolder.Id,
+		}
+		if action.SlackMessage != "" {
+			if p, err := loadParticipants(); err != nil {
+				z.logger.Printf("failed to list participants of %q: %s", meeting.Topic, err)
+			} else {
+				n.Participants = p
+				n.ParticipantNames = participantNames(p)
+				n.ParticipantCount = len(n.ParticipantNames)
+			}
+		}
+		body, err := n.render(action.SlackMessage)
+		if err != nil {
+			z.logger.Printf("failed to render slack message for %q: %s", meeting.Topic, err)
+			body, _ = n.render(defaultSlackMessage)
+		}
+		channel, ts, text, err := z.slackClient.SendMessageContext(ctx, action.Slack, slackapi.MsgOptionText(body, true))
 		if err != nil {
 			z.logger.Printf("failed to notify slack %q: %s", action.Slack, err)
 			apm.CaptureError(ctx, err).Send()
 		} else {
 			z.logger.Printf("notified slack %q: %s", channel, text)
+			if action.ChatLinks {
+				z.notifyChatLinks(ctx, channel, ts, chatLinks)
+			}
 		}
 		slackSpan.End()
 	}
 	curArchMeeting.status = "done"
+	if len(processing) > 0 {
+		curArchMeeting.status = "pending"
+	}
 	return nil
 }
 
@@ -484,13 +921,72 @@ type runParams struct {
 	uploadFilter string
 }
 
+// lock keeps other processes from archiving until release is called
+func (z *Config) lock(ctx context.Context) (func(), error) {
+	if z.lockPath == "" {
+		return func() {}, nil
+	}
+	l, err := lock.Acquire(ctx, z.lockPath, z.lockWait)
+	if err != nil {
+		return nil, err
+	}
+	if l.Stale != nil {
+		z.logger.Printf("recovered stale lock %s left by %s", z.lockPath, l.Stale)
+	}
+	return func() {
+		if err := l.Release(); err != nil {
+			z.logger.Printf("failed to release %s: %s", z.lockPath, err)
+		}
+	}, nil
+}
+
 func (z *Config) Run(params runParams) error {
 	tx := apm.DefaultTracer.StartTransaction("archiveRecordings", "background")
 	defer tx.End()
 	ctx := apm.ContextWithTransaction(context.Background(), tx)
 
-	z.logger.Print("archiving recordings")
+	release, err := z.lock(ctx)
+	if err != nil {
+		return fmt.Errorf("archiving skipped: %w", err)
+	}
+	defer release()
+
+	if err := z.preRunHook(ctx); err != nil {
+		return fmt.Errorf("archiving skipped: %w", err)
+	}
 	archDetails = []*archivedMeeting{}
+	err = z.run(ctx, params)
+	z.postRunHook(ctx, err)
+	return err
+}
+
+// run archives recordings while holding the lock
+func (z *Config) run(ctx context.Context, params runParams) error {
+	var err error
+	if z.pendingPath != "" {
+		if z.pending, err = loadPending(z.pendingPath); err != nil {
+			z.logger.Printf("failed to load pending recordings from %s: %s", z.pendingPath, err)
+			z.pending = newPending(z.pendingPath)
+		}
+		defer func() {
+			if err := z.pending.save(); err != nil {
+				z.logger.Printf("failed to save pending recordings to %s: %s", z.pendingPath, err)
+			}
+			z.pending = nil
+		}()
+	}
+
+	gdrive, err := z.googleClient.Drive(ctx)
+	if err != nil {
+		return fmt.Errorf("while creating gdrive client: %w", err)
+	}
+	z.loadFolders(ctx, gdrive)
+	defer z.saveFolders()
+	z.loadIndex()
+	defer z.saveIndex()
+
+	z.logger.Print("archiving recordings")
+	seen := make(map[string]bool)
 	nextPageToken := ""
 	for {
 		recordings, err := z.zoomClient.ListRecordings(ctx, time.Now().Add(-1*params.since), nextPageToken)
@@ -499,10 +995,16 @@ func (z *Config) Run(params runParams) error {
 			return fmt.Errorf("failed to list recordings: %w", err)
 		}
 		for _, meeting := range recordings.Meetings {
-			if meeting.Duration < params.minDuration {
+			seen[meeting.UUID] = true
+			action := z.copies[meeting.ID]
+			if time.Duration(meeting.Duration)*time.Minute < action.minDuration(params) {
 				z.logger.Printf("skipped %d minute meeting at %s", meeting.Duration, meeting.StartTime)
 				continue
 			}
+			if action.tooOld(meeting, time.Now()) {
+				z.logger.Printf("skipped meeting at %s, older than %s", meeting.StartTime, action.MaxAge)
+				continue
+			}
 			if err := z.Archive(ctx, meeting, params); err != nil {
 				z.logger.Print(err)
 				apm.CaptureError(ctx, err).Send()
@@ -513,10 +1015,38 @@ func (z *Config) Run(params runParams) error {
 			break
 		}
 	}
+	z.archivePending(ctx, seen, params)
 	z.logger.Print("done archiving recordings")
 	return nil
 }
 
+// archivePending rechecks meetings that were still processing on earlier runs and are no longer listed
+func (z *Config) archivePending(ctx context.Context, seen map[string]bool, params runParams) {
+	for _, m := range z.pending.expire(time.Now().Add(-pendingTTL)) {
+		z.logger.Printf("gave up waiting on zoom to process recordings of %q at %s", m.Topic, m.StartTime)
+	}
+	for _, m := range z.pending.list() {
+		if seen[m.UUID] {
+			continue
+		}
+		meeting, err := z.zoomClient.GetMeetingRecordings(ctx, m.UUID)
+		if err != nil {
+			if errors.Is(err, zoom.ErrNotFound) {
+				z.logger.Printf("recordings of %q at %s no longer exist", m.Topic, m.StartTime)
+				z.pending.set(zoom.Meeting{UUID: m.UUID}, nil)
+				continue
+			}
+			z.logger.Printf("failed to recheck recordings of %q: %s", m.Topic, err)
+			apm.CaptureError(ctx, err).Send()
+			continue
+		}
+		if err := z.Archive(ctx, *meeting, params); err != nil {
+			z.logger.Print(err)
+			apm.CaptureError(ctx, err).Send()
+		}
+	}
+}
+
 type archivedMeeting struct {
 	name           string
 	fileNumber     int
@@ -566,80 +1096,31 @@ func doRun(zat *Config, params runParams) {
 	archIsRunningMu.Unlock()
 }
 
-func main() {
-	cfgDir := cmd.FlagConfigDir()
-	addr := flag.String("addr", "localhost:8080", "web server listener address")
-	noServer := flag.Bool("no-server", false, "don't start web server")
-	minDuration := flag.Int("min-duration", 5, "minimum meeting duration in minutes to archive")
-	since := flag.Duration("since", 168*time.Hour, "since")
-	uploadFilter := flag.String("t", "",
-		"comma separated list of file types to archive (mp4, m4a, timeline, transcript, chat, cc, csv), see: "+
-			"https://marketplace.zoom.us/docs/api-reference/zoom-api/cloud-recording/recordingget")
-	flag.Parse()
-
-	logger := log.New(os.Stderr, "", cmd.LogFmt)
+// retryPending runs again every interval while recordings are still processing
+func retryPending(zat *Config, params runParams, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		pending, err := loadPending(zat.pendingPath)
+		if err != nil {
+			zat.logger.Printf("failed to load pending recordings from %s: %s", zat.pendingPath, err)
+			continue
+		}
+		if len(pending.list()) > 0 {
+			doRun(zat, params)
+		}
+	}
+}
 
+func main() {
 	// Instrument http.DefaultClient and http.DefaultTransport.
 	http.DefaultClient = apmhttp.WrapClient(http.DefaultClient)
 	http.DefaultTransport = apmhttp.WrapRoundTripper(http.DefaultTransport)
 
-	googleClient, err := google.NewClientFromFile(
-		logger,
-		path.Join(*cfgDir, cmd.GoogleConfigPath),
-		google.NewCredentialsManager(path.Join(*cfgDir, cmd.GoogleCredsPath)).ClientOption,
-	)
-	if err != nil {
-		logger.Fatal(err)
-	}
-	zoomClient, err := zoom.NewClientFromFile(
-		logger,
-		path.Join(*cfgDir, cmd.ZoomConfigPath),
-		zoom.NewCredentialsManager(path.Join(*cfgDir, cmd.ZoomCredsPath)).ClientOption,
-	)
-	if err != nil {
-		logger.Fatal(err)
-	}
-	slackClient, _ := slack.NewClientFromEnvOrFile(logger, path.Join(*cfgDir, cmd.SlackConfigPath), slackapi.OptionHTTPClient(http.DefaultClient))
-	rp := runParams{
-		minDuration:  *minDuration,
-		since:        *since,
-		uploadFilter: *uploadFilter,
-	}
-
-	zat, err := NewConfigFromFile(logger, path.Join(*cfgDir, cmd.ZatConfigPath), googleClient, zoomClient, slackClient)
-	if err != nil {
-		// ok to continue without config, just can't do archival
-		logger.Println("failed to load config", err)
-	}
-
-	var wg sync.WaitGroup
-	if !*noServer {
-		wg.Add(1)
-		server := http.Server{
-			Addr:    *addr,
-			Handler: apmhttp.Wrap(NewMux(zat, rp)),
-		}
-		go func() {
-			logger.Printf("starting on http://%s", server.Addr)
-			if err := server.ListenAndServe(); err != nil {
-				logger.Fatal(err)
-			}
-			wg.Done()
-		}()
-	}
-
-	if zat != nil {
-		// already logged that config is loaded, just skip the run
-		wg.Add(1)
-		go func() {
-			doRun(zat, rp)
-			wg.Done()
-		}()
-	}
-
-	wg.Wait()
+	code := runCLI(os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
 	apm.DefaultTracer.Flush(ctx.Done())
+	cancel()
+	os.Exit(code)
 }
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"go.elastic.co/apm"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+
+	"github.com/graphaelli/zat/google"
+	"github.com/graphaelli/zat/zoom"
+)
+
+const (
+	readmeMarkdown = "md"
+	readmeDoc      = "doc"
+
+	metadataFileName = "meeting.json"
+	// metadataFormat tags the meeting.json sidecar, readmes are tagged readme.<format>
+	metadataFormat = "meeting.json"
+)
+
+// sidecarFields are the fields needed to describe archived files and update sidecars
+const sidecarFields googleapi.Field = "nextPageToken, files(id, name, mimeType, size, createdTime, webViewLink, appProperties)"
+
+// sidecarProperties tags a sidecar, which has no recording
+func sidecarProperties(meeting zoom.Meeting, format string) map[string]string {
+	return fileProperties(meeting, zoom.RecordingFile{}, format)
+}
+
+func readmeFormat(format string) string {
+	return "readme." + format
+}
+
+func isSidecar(format string) bool {
+	return format == metadataFormat || strings.HasPrefix(format, "readme.")
+}
+
+// readmeFileName is the name of the readme in format
+func readmeFileName(format string) string {
+	if format == readmeDoc {
+		// google docs don't have an extension
+		return "README"
+	}
+	return "README." + format
+}
+
+// meetingMetadata describes a meeting and what has been archived from it, written to meeting.json
+type meetingMetadata struct {
+	UUID      string `json:"uuid"`
+	ID        int64  `json:"id"`
+	Topic     string `json:"topic"`
+	HostID    string `json:"host_id,omitempty"`
+	HostEmail string `json:"host_email,omitempty"`
+	// StartTime is in the timezone of the meeting
+	StartTime time.Time `json:"start_time"`
+	Timezone  string    `json:"timezone,omitempty"`
+	// Duration is in minutes, as reported by zoom
+	Duration   int                 `json:"duration"`
+	ShareURL   string              `json:"share_url,omitempty"`
+	FolderURL  string              `json:"folder_url"`
+	Recordings []recordingMetadata `json:"recordings"`
+	Files      []archivedFile      `json:"files"`
+}
+
+// recordingMetadata is a zoom recording file, without its download URL
+type recordingMetadata struct {
+	ID             string `json:"id,omitempty"`
+	FileType       string `json:"file_type"`
+	RecordingType  string `json:"recording_type,omitempty"`
+	FileSize       int    `json:"file_size,omitempty"`
+	RecordingStart string `json:"recording_start,omitempty"`
+	RecordingEnd   string `json:"recording_end,omitempty"`
+	Status         string `json:"status,omitempty"`
+}
+
+// archivedFile is a file in the meeting folder
+type archivedFile struct {
+	Name        string `json:"name"`
+	ID          string `json:"id"`
+	URL         string `json:"url,omitempty"`
+	MimeType    string `json:"mime_type,omitempty"`
+	RecordingID string `json:"recording_id,omitempty"`
+	FileType    string `json:"file_type,omitempty"`
+	Format      string `json:"format,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	ArchivedAt  string `json:"archived_at,omitempty"`
+}
+
+// meetingStart is when meeting started in its own timezone, UTC when the timezone is unknown
+func meetingStart(meeting zoom.Meeting) time.Time {
+	if meeting.Timezone != "" {
+		if loc, err := time.LoadLocation(meeting.Timezone); err == nil {
+			return meeting.StartTime.In(loc)
+		}
+	}
+	return meeting.StartTime.UTC()
+}
+
+// newMeetingMetadata describes meeting and the files archived from it to folder, excluding sidecars
+func newMeetingMetadata(meeting zoom.Meeting, folder *drive.File, files []*drive.File) meetingMetadata {
+	m := meetingMetadata{
+		UUID:       meeting.UUID,
+		ID:         meeting.ID,
+		Topic:      meeting.Topic,
+		HostID:     meeting.HostID,
+		HostEmail:  meeting.HostEmail,
+		StartTime:  meetingStart(meeting),
+		Timezone:   meeting.Timezone,
+		Duration:   meeting.Duration,
+		ShareURL:   meeting.ShareURL,
+		FolderURL:  "https://drive.google.com/drive/folders/" + folder.Id,
+		Recordings: make([]recordingMetadata, len(meeting.RecordingFiles)),
+		Files:      []archivedFile{},
+	}
+	for i, f := range meeting.RecordingFiles {
+		m.Recordings[i] = recordingMetadata{
+			ID:             f.ID,
+			FileType:       strings.ToLower(f.FileType),
+			RecordingType:  f.RecordingType,
+			FileSize:       f.FileSize,
+			RecordingStart: f.RecordingStart,
+			RecordingEnd:   f.RecordingEnd,
+			Status:         f.Status,
+		}
+	}
+	for _, f := range files {
+		if isSidecar(f.AppProperties[propFormat]) {
+			continue
+		}
+		m.Files = append(m.Files, archivedFile{
+			Name:        f.Name,
+			ID:          f.Id,
+			URL:         f.WebViewLink,
+			MimeType:    f.MimeType,
+			RecordingID: f.AppProperties[propRecordingID],
+			FileType:    f.AppProperties[propFileType],
+			Format:      f.AppProperties[propFormat],
+			Size:        f.Size,
+			ArchivedAt:  f.CreatedTime,
+		})
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Name < m.Files[j].Name })
+	return m
+}
+
+// formatSize renders a file size for people
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// facts are the meeting details listed at the top of a readme, in order
+func (m meetingMetadata) facts() [][2]string {
+	host := m.HostEmail
+	if host == "" {
+		host = m.HostID
+	}
+	facts := [][2]string{
+		{"Start", m.StartTime.Format("Mon, 02 Jan 2006 15:04 MST")},
+		{"Duration", fmt.Sprintf("%d minutes", m.Duration)},
+		{"Host", host},
+		{"Meeting ID", fmt.Sprint(m.ID)},
+		{"Meeting UUID", m.UUID},
+	}
+	if m.ShareURL != "" {
+		facts = append(facts, [2]string{"Zoom recording", m.ShareURL})
+	}
+	return facts
+}
+
+// renderReadmeMarkdown writes m as a markdown document
+func renderReadmeMarkdown(w io.Writer, m meetingMetadata) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# %s\n\n", m.Topic)
+	for _, fact := range m.facts() {
+		fmt.Fprintf(bw, "* %s: %s\n", fact[0], fact[1])
+	}
+	fmt.Fprint(bw, "\n## Files\n\n| File | Type | Size | Archived |\n| --- | --- | --- | --- |\n")
+	for _, f := range m.Files {
+		name := strings.ReplaceAll(f.Name, "|", "\\|")
+		if f.URL != "" {
+			name = fmt.Sprintf("[%s](%s)", name, f.URL)
+		}
+		fmt.Fprintf(bw, "| %s | %s | %s | %s |\n", name, f.describe(), f.size(), f.ArchivedAt)
+	}
+	return bw.Flush()
+}
+
+// renderReadmeHTML writes m as a standalone html document, suitable for conversion to a Google Doc.
+func renderReadmeHTML(w io.Writer, m meetingMetadata) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "<html><head><meta charset=\"utf-8\"><title>%s</title></head><body>\n<h1>%s</h1>\n<ul>\n",
+		html.EscapeString(m.Topic), html.EscapeString(m.Topic))
+	for _, fact := range m.facts() {
+		fmt.Fprintf(bw, "<li>%s: %s</li>\n", html.EscapeString(fact[0]), html.EscapeString(fact[1]))
+	}
+	fmt.Fprint(bw, "</ul>\n<h2>Files</h2>\n<table>\n<tr><th>File</th><th>Type</th><th>Size</th><th>Archived</th></tr>\n")
+	for _, f := range m.Files {
+		name := html.EscapeString(f.Name)
+		if f.URL != "" {
+			name = fmt.Sprintf("<a href=\"%s\">%s</a>", html.EscapeString(f.URL), name)
+		}
+		fmt.Fprintf(bw, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+			name, html.EscapeString(f.describe()), f.size(), html.EscapeString(f.ArchivedAt))
+	}
+	fmt.Fprint(bw, "</table>\n</body></html>\n")
+	return bw.Flush()
+}
+
+// describe is the type of f, with the conversion format if any
+func (f archivedFile) describe() string {
+	if f.Format != "" && f.FileType != "" {
+		return f.FileType + " (" + f.Format + ")"
+	}
+	if f.FileType == "" {
+		return f.Format
+	}
+	return f.FileType
+}
+
+func (f archivedFile) size() string {
+	if f.Size == 0 {
+		// eg google docs, which don't count against quota
+		return ""
+	}
+	return formatSize(f.Size)
+}
+
+// renderReadme renders m in format, returning the drive file to create with it.
+func renderReadme(format string, m meetingMetadata) (*drive.File, []byte, string, error) {
+	var buf bytes.Buffer
+	file := &drive.File{}
+	var contentType string
+	var err error
+	switch format {
+	case readmeDoc:
+		// drive converts html uploads to a google doc
+		file.MimeType = google.MimeTypeDocument
+		contentType = "text/html"
+		err = renderReadmeHTML(&buf, m)
+	case readmeMarkdown:
+		contentType = "text/markdown"
+		err = renderReadmeMarkdown(&buf, m)
+	default:
+		err = fmt.Errorf("unknown readme format %q", format)
+	}
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return file, buf.Bytes(), contentType, nil
+}
+
+// hasSidecars reports whether meeting.json and the readmes of action have been archived
+func hasSidecars(a archived, meeting zoom.Meeting, action Directive) bool {
+	if !a.has(sidecarProperties(meeting, metadataFormat), metadataFileName) {
+		return false
+	}
+	for _, format := range action.Readme {
+		if !a.has(sidecarProperties(meeting, readmeFormat(format)), readmeFileName(format)) {
+			return false
+		}
+	}
+	return true
+}
+
+// archiveMetadata writes meeting.json, and the readmes of action, to the meeting folder,
+// updating them when they no longer match what has been archived.
+func (z *Config) archiveMetadata(ctx context.Context, gdrive *google.Drive, folder *drive.File, meeting zoom.Meeting, action Directive) error {
+	span, ctx := apm.StartSpan(ctx, "archiveMetadata", "app")
+	defer span.End()
+
+	files, err := listFolder(ctx, gdrive, folder, meeting, sidecarFields)
+	if err != nil {
+		return fmt.Errorf("while listing meeting folder: %w", err)
+	}
+	sidecars := make(map[string]*drive.File)
+	for _, f := range files {
+		if format := f.AppProperties[propFormat]; isSidecar(format) {
+			sidecars[format] = f
+		}
+	}
+	m := newMeetingMetadata(meeting, folder, files)
+
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("while encoding %s: %w", metadataFileName, err)
+	}
+	if err := z.writeSidecar(ctx, gdrive, folder, sidecars[metadataFormat], &drive.File{
+		Name:          metadataFileName,
+		AppProperties: sidecarProperties(meeting, metadataFormat),
+	}, append(body, '\n'), "application/json"); err != nil {
+		return err
+	}
+
+	for _, format := range action.Readme {
+		file, body, contentType, err := renderReadme(format, m)
+		if err != nil {
+			return err
+		}
+		file.Name = readmeFileName(format)
+		file.AppProperties = sidecarProperties(meeting, readmeFormat(format))
+		if err := z.writeSidecar(ctx, gdrive, folder, sidecars[readmeFormat(format)], file, body, contentType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSidecar creates file in folder with body, or replaces the content of existing when it differs
+func (z *Config) writeSidecar(ctx context.Context, gdrive *google.Drive, folder, existing, file *drive.File, body []byte, contentType string) error {
+	if existing == nil {
+		file.Parents = []string{folder.Id}
+		if _, err := uploadBytes(ctx, gdrive, file, body, contentType); err != nil {
+			return fmt.Errorf("while creating %s: %w", file.Name, err)
+		}
+		z.logger.Printf("created %q in %s", file.Name, folder.Name)
+		return nil
+	}
+	sum := checksum(body)
+	if existing.AppProperties[propChecksum] == sum {
+		return nil
+	}
+	if _, err := gdrive.UpdateContent(ctx, existing.Id, &drive.File{
+		AppProperties: map[string]string{propChecksum: sum},
+	}, bytes.NewReader(body), googleapi.ContentType(contentType)); err != nil {
+		return fmt.Errorf("while updating %s: %w", existing.Name, err)
+	}
+	z.logger.Printf("updated %q in %s", existing.Name, folder.Name)
+	return nil
+}
@@ -0,0 +1,155 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// StateTTL is how long a login has to complete
+const StateTTL = 10 * time.Minute
+
+var (
+	// ErrStateMissing is returned when the login cookie has expired or the login was started in another browser.
+	ErrStateMissing = errors.New("login expired or was started elsewhere")
+	// ErrStateMismatch is returned when the callback state doesn't match the login that was started.
+	ErrStateMismatch = errors.New("login state mismatch")
+)
+
+// Flow guards an authorization code flow against CSRF with a random state per login, bound to the browser
+// with a short lived cookie, and protects the code exchange with PKCE.
+type Flow struct {
+	// Name distinguishes concurrent logins to different providers
+	Name   string
+	Config *oauth2.Config
+	// PKCE enables RFC 7636 proof key for code exchange, for providers that support it
+	PKCE bool
+}
+
+func (f *Flow) cookieName() string {
+	return "zat_oauth_" + f.Name
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// S256Challenge computes the PKCE code challenge for verifier
+func S256Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// start generates the state and, with PKCE, the code verifier of a new login, adding the challenge to opts.
+func (f *Flow) start(opts []oauth2.AuthCodeOption) (state, verifier string, _ []oauth2.AuthCodeOption, err error) {
+	if state, err = randomString(); err != nil {
+		return "", "", nil, err
+	}
+	if f.PKCE {
+		if verifier, err = randomString(); err != nil {
+			return "", "", nil, err
+		}
+		opts = append(opts,
+			oauth2.SetAuthURLParam("code_challenge", S256Challenge(verifier)),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		)
+	}
+	return state, verifier, opts, nil
+}
+
+// exchange trades code for a token, proving possession of verifier with PKCE.
+func (f *Flow) exchange(ctx context.Context, config *oauth2.Config, code, verifier string) (*oauth2.Token, error) {
+	var opts []oauth2.AuthCodeOption
+	if f.PKCE {
+		opts = append(opts, oauth2.SetAuthURLParam("code_verifier", verifier))
+	}
+	return config.Exchange(ctx, code, opts...)
+}
+
+// AuthCodeURL starts a new login, remembering its state in a cookie, and returns the URL to send the user to.
+func (f *Flow) AuthCodeURL(w http.ResponseWriter, r *http.Request, opts ...oauth2.AuthCodeOption) (string, error) {
+	state, verifier, opts, err := f.start(opts)
+	if err != nil {
+		return "", err
+	}
+	value := state
+	if f.PKCE {
+		value += "." + verifier
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     f.cookieName(),
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(StateTTL / time.Second),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		// sent along with the redirect back from the provider
+		SameSite: http.SameSiteLaxMode,
+	})
+	return f.Config.AuthCodeURL(state, opts...), nil
+}
+
+// IsCallback reports whether r is the provider redirecting back after a login, successful or not
+func IsCallback(r *http.Request) bool {
+	return r.FormValue("code") != "" || r.FormValue("error") != ""
+}
+
+// Exchange validates the callback state against the login cookie and exchanges the code for a token.
+func (f *Flow) Exchange(ctx context.Context, w http.ResponseWriter, r *http.Request) (*oauth2.Token, error) {
+	cookie, err := r.Cookie(f.cookieName())
+	if err != nil || cookie.Value == "" {
+		return nil, ErrStateMissing
+	}
+	// a login state is only good once
+	http.SetCookie(w, &http.Cookie{Name: f.cookieName(), Path: "/", MaxAge: -1})
+	if e := r.FormValue("error"); e != "" {
+		// eg access_denied when the user declines
+		return nil, fmt.Errorf("%s %s", e, r.FormValue("error_description"))
+	}
+
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	state := r.FormValue("state")
+	if state == "" || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(state)) != 1 {
+		return nil, ErrStateMismatch
+	}
+	verifier := ""
+	if f.PKCE {
+		if len(parts) != 2 {
+			return nil, ErrStateMismatch
+		}
+		verifier = parts[1]
+	}
+	return f.exchange(ctx, f.Config, r.FormValue("code"), verifier)
+}
+
+// IsStateError reports whether err is due to a missing, expired or mismatched login state
+func IsStateError(err error) bool {
+	return errors.Is(err, ErrStateMissing) || errors.Is(err, ErrStateMismatch)
+}
+
+// ErrorPage explains a failed login, linking to retry it.
+// Only a bad login state is the browser's fault, anything else went wrong with the provider.
+func ErrorPage(w http.ResponseWriter, provider string, err error, retry string) {
+	status := http.StatusBadGateway
+	if IsStateError(err) {
+		status = http.StatusBadRequest
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<html><body><h1>%s login failed</h1><p>%s.</p><p><a href=\"%s\">Try again</a></p></body></html>",
+		html.EscapeString(provider), html.EscapeString(err.Error()), html.EscapeString(retry))
+}
@@ -0,0 +1,29 @@
+package oauth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS256Challenge(t *testing.T) {
+	// https://tools.ietf.org/html/rfc7636#appendix-B
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", S256Challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"))
+}
+
+func TestErrorPage(t *testing.T) {
+	for err, status := range map[error]int{
+		ErrStateMissing: http.StatusBadRequest,
+		fmt.Errorf("login: %w", ErrStateMismatch): http.StatusBadRequest,
+		errors.New("connection refused"):          http.StatusBadGateway,
+	} {
+		w := httptest.NewRecorder()
+		ErrorPage(w, "Zoom", err, "/oauth/zoom")
+		assert.Equal(t, status, w.Code, err.Error())
+		assert.Contains(t, w.Body.String(), err.Error())
+	}
+}
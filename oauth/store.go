@@ -0,0 +1,187 @@
+// Package oauth holds OAuth2 token handling shared by the google and zoom clients.
+package oauth
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2"
+
+	"github.com/graphaelli/zat/atomicfile"
+)
+
+const (
+	// KeyEnv is the environment variable holding the base64 encoded credentials encryption key
+	KeyEnv = "ZAT_CREDS_KEY"
+	// KeySize is the size of credentials encryption keys, for AES-256
+	KeySize = 32
+
+	encryptedVersion   = 1
+	encryptedAlgorithm = "AES-256-GCM"
+)
+
+// ErrNotEncrypted is returned when loading plaintext credentials from an encrypted store.
+var ErrNotEncrypted = errors.New("credentials are not encrypted")
+
+// Store persists OAuth tokens.
+type Store interface {
+	Load() (*oauth2.Token, error)
+	Save(*oauth2.Token) error
+}
+
+// FileStore persists tokens as plaintext json.
+type FileStore struct {
+	Path string
+}
+
+func (s FileStore) Load() (*oauth2.Token, error) {
+	b, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeToken(b)
+}
+
+func (s FileStore) Save(token *oauth2.Token) error {
+	b, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(s.Path, b)
+}
+
+// EncryptedFileStore persists tokens as json, encrypted with AES-256-GCM.
+type EncryptedFileStore struct {
+	Path string
+	Key  []byte
+}
+
+// encryptedFile is the on disk format of an EncryptedFileStore
+type encryptedFile struct {
+	Version    int    `json:"version"`
+	Algorithm  string `json:"algorithm"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func (s EncryptedFileStore) aead() (cipher.AEAD, error) {
+	if len(s.Key) != KeySize {
+		return nil, fmt.Errorf("credentials key must be %d bytes, got %d", KeySize, len(s.Key))
+	}
+	block, err := aes.NewCipher(s.Key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s EncryptedFileStore) Load() (*oauth2.Token, error) {
+	b, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	var f encryptedFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	if f.Version == 0 && f.Ciphertext == nil {
+		return nil, fmt.Errorf("%s: %w", s.Path, ErrNotEncrypted)
+	}
+	if f.Version != encryptedVersion || f.Algorithm != encryptedAlgorithm {
+		return nil, fmt.Errorf("%s: unsupported encryption %d/%s", s.Path, f.Version, f.Algorithm)
+	}
+	aead, err := s.aead()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, f.Nonce, f.Ciphertext, []byte(encryptedAlgorithm))
+	if err != nil {
+		return nil, fmt.Errorf("%s: while decrypting credentials, wrong key?: %w", s.Path, err)
+	}
+	return decodeToken(plaintext)
+}
+
+func (s EncryptedFileStore) Save(token *oauth2.Token) error {
+	aead, err := s.aead()
+	if err != nil {
+		return err
+	}
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	b, err := json.Marshal(encryptedFile{
+		Version:    encryptedVersion,
+		Algorithm:  encryptedAlgorithm,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, []byte(encryptedAlgorithm)),
+	})
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(s.Path, b)
+}
+
+// NewStore returns an encrypted store for path if a key is provided, otherwise a plaintext one.
+func NewStore(path string, key []byte) Store {
+	if key == nil {
+		return FileStore{Path: path}
+	}
+	return EncryptedFileStore{Path: path, Key: key}
+}
+
+// LoadKey reads the credentials encryption key from keyFile, if provided, otherwise from the environment.
+// A nil key is returned when neither is configured.
+func LoadKey(keyFile string) ([]byte, error) {
+	encoded := os.Getenv(KeyEnv)
+	source := KeyEnv
+	if keyFile != "" {
+		b, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(b)
+		source = keyFile
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("while decoding credentials key from %s: %w", source, err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("credentials key from %s must be %d bytes, got %d", source, KeySize, len(key))
+	}
+	return key, nil
+}
+
+// GenerateKey returns a new random, base64 encoded, credentials encryption key.
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func decodeToken(b []byte) (*oauth2.Token, error) {
+	var token oauth2.Token
+	if err := json.NewDecoder(bytes.NewReader(b)).Decode(&token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
@@ -0,0 +1,80 @@
+package oauth
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func testToken() *oauth2.Token {
+	return &oauth2.Token{
+		AccessToken:  "test_access_token",
+		TokenType:    "bearer",
+		RefreshToken: "test_refresh_token",
+		Expiry:       time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func TestEncryptedFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zat")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "creds.json")
+
+	key, err := GenerateKey()
+	require.NoError(t, err)
+	rawKey, err := base64.StdEncoding.DecodeString(key)
+	require.NoError(t, err)
+
+	// plaintext credentials must be migrated first
+	require.NoError(t, FileStore{Path: p}.Save(testToken()))
+	_, err = EncryptedFileStore{Path: p, Key: rawKey}.Load()
+	assert.True(t, errors.Is(err, ErrNotEncrypted))
+
+	store := NewStore(p, rawKey)
+	require.NoError(t, store.Save(testToken()))
+	b, err := ioutil.ReadFile(p)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "test_refresh_token")
+
+	token, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, testToken().RefreshToken, token.RefreshToken)
+	assert.True(t, testToken().Expiry.Equal(token.Expiry))
+
+	wrongKey := make([]byte, KeySize)
+	_, err = EncryptedFileStore{Path: p, Key: wrongKey}.Load()
+	assert.Error(t, err)
+}
+
+func TestLoadKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zat")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer os.Setenv(KeyEnv, os.Getenv(KeyEnv))
+
+	os.Setenv(KeyEnv, "")
+	key, err := LoadKey("")
+	require.NoError(t, err)
+	assert.Nil(t, key)
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", KeySize)))
+	os.Setenv(KeyEnv, encoded)
+	key, err = LoadKey("")
+	require.NoError(t, err)
+	assert.Len(t, key, KeySize)
+
+	keyFile := filepath.Join(dir, "key")
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("c2hvcnQ=\n"), 0600))
+	_, err = LoadKey(keyFile)
+	assert.Error(t, err, "file takes precedence and holds a short key")
+}
@@ -0,0 +1,170 @@
+package oauth
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// ErrNotLoopback is returned when a loopback login is attempted with a redirect URL on another host.
+var ErrNotLoopback = errors.New("redirect URL is not a loopback address")
+
+// Prompt is how a login started from a terminal interacts with the user
+type Prompt struct {
+	In  io.Reader
+	Out io.Writer
+}
+
+// isLoopback reports whether host is a loopback address, or a name only resolving to loopback addresses
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+	addrs, err := net.LookupHost(host)
+	if err != nil || len(addrs) == 0 {
+		return false
+	}
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip == nil || !ip.IsLoopback() {
+			return false
+		}
+	}
+	return true
+}
+
+// LoopbackLogin logs in with a browser on this machine, receiving the redirect on a temporary listener at redirect.
+// A redirect URL without a port listens on a random one, as allowed for native apps by RFC 8252 and google.
+func (f *Flow) LoopbackLogin(ctx context.Context, p Prompt, redirect string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	u, err := url.Parse(redirect)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing redirect URL: %w", err)
+	}
+	if u.Scheme != "http" || !isLoopback(u.Hostname()) {
+		return nil, fmt.Errorf("%w: %s", ErrNotLoopback, redirect)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "0"
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, fmt.Errorf("while listening for the login redirect: %w", err)
+	}
+	defer listener.Close()
+	u.Host = net.JoinHostPort(u.Hostname(), fmt.Sprint(listener.Addr().(*net.TCPAddr).Port))
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	config := *f.Config
+	config.RedirectURL = u.String()
+	state, verifier, opts, err := f.start(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		code string
+		err  error
+	}
+	results := make(chan result, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != u.Path || !IsCallback(r) {
+			http.NotFound(w, r)
+			return
+		}
+		code, err := callbackCode(r.URL.Query(), state)
+		if err != nil {
+			http.Error(w, f.Name+" login failed: "+err.Error(), http.StatusBadRequest)
+		} else {
+			fmt.Fprintf(w, "<html><body><h1>%s login complete</h1><p>You can close this window.</p></body></html>", f.Name)
+		}
+		select {
+		case results <- result{code: code, err: err}:
+		default:
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	fmt.Fprintf(p.Out, "Open this URL in a browser on this machine to log in to %s:\n\n%s\n\n", f.Name, config.AuthCodeURL(state, opts...))
+	ctx, cancel := context.WithTimeout(ctx, StateTTL)
+	defer cancel()
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("while waiting for the login redirect: %w", ctx.Err())
+	case res := <-results:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return f.exchange(ctx, &config, res.code, verifier)
+	}
+}
+
+// PasteLogin logs in with a browser anywhere, the user pastes back the URL they were redirected to, or just its code.
+// The redirect doesn't need to load, which suits servers without a browser that can't be reached from one.
+func (f *Flow) PasteLogin(ctx context.Context, p Prompt, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	state, verifier, opts, err := f.start(opts)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(p.Out, "Open this URL in any browser to log in to %s:\n\n%s\n\n", f.Name, f.Config.AuthCodeURL(state, opts...))
+	fmt.Fprintf(p.Out, "The browser is then sent to %s, which may fail to load.\n", f.Config.RedirectURL)
+	fmt.Fprint(p.Out, "Paste the URL from the address bar: ")
+
+	line, err := bufio.NewReader(p.In).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return nil, fmt.Errorf("while reading the redirect URL: %w", err)
+	}
+	code, err := pastedCode(strings.TrimSpace(line), state)
+	if err != nil {
+		return nil, err
+	}
+	return f.exchange(ctx, f.Config, code, verifier)
+}
+
+// pastedCode extracts the authorization code from a pasted redirect URL, or a bare code
+func pastedCode(pasted, state string) (string, error) {
+	if pasted == "" {
+		return "", errors.New("no code provided")
+	}
+	if !strings.Contains(pasted, "code=") && !strings.Contains(pasted, "error=") {
+		return pasted, nil
+	}
+	query := pasted
+	if i := strings.Index(pasted, "?"); i >= 0 {
+		query = pasted[i+1:]
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", fmt.Errorf("while parsing pasted URL: %w", err)
+	}
+	return callbackCode(values, state)
+}
+
+// callbackCode validates the state of a login redirect, returning its authorization code
+func callbackCode(values url.Values, state string) (string, error) {
+	if e := values.Get("error"); e != "" {
+		// eg access_denied when the user declines
+		return "", fmt.Errorf("%s %s", e, values.Get("error_description"))
+	}
+	if subtle.ConstantTimeCompare([]byte(values.Get("state")), []byte(state)) != 1 {
+		return "", ErrStateMismatch
+	}
+	if values.Get("code") == "" {
+		return "", errors.New("no code provided")
+	}
+	return values.Get("code"), nil
+}
@@ -0,0 +1,141 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// tokenServer exchanges code for a token, checking the PKCE verifier against the challenge sent to the user
+func tokenServer(t *testing.T, challenge *string, redirect *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "authorization_code", r.FormValue("grant_type"))
+		assert.Equal(t, "the_code", r.FormValue("code"))
+		assert.Equal(t, *challenge, S256Challenge(r.FormValue("code_verifier")))
+		assert.Equal(t, *redirect, r.FormValue("redirect_uri"))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "the_access_token",
+			"refresh_token": "the_refresh_token",
+			"token_type":    "bearer",
+			"expires_in":    3600,
+		})
+	}))
+}
+
+// promptWriter passes the login URL printed for the user to urls
+type promptWriter chan *url.URL
+
+var promptURL = regexp.MustCompile(`(?m)^https?://\S+$`)
+
+func (p promptWriter) Write(b []byte) (int, error) {
+	if m := promptURL.Find(b); m != nil {
+		u, err := url.Parse(string(m))
+		if err != nil {
+			return 0, err
+		}
+		p <- u
+	}
+	return len(b), nil
+}
+
+func TestLoopbackLogin(t *testing.T) {
+	var challenge, redirect string
+	server := tokenServer(t, &challenge, &redirect)
+	defer server.Close()
+
+	flow := &Flow{Name: "test", PKCE: true, Config: &oauth2.Config{
+		ClientID: "id",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://provider.example/auth", TokenURL: server.URL},
+	}}
+	urls := make(promptWriter, 1)
+	go func() {
+		u := <-urls
+		challenge = u.Query().Get("code_challenge")
+		redirect = u.Query().Get("redirect_uri")
+		assert.Regexp(t, `^http://127.0.0.1:\d+/callback$`, redirect)
+		rsp, err := http.Get(redirect + "?" + url.Values{"code": {"the_code"}, "state": {u.Query().Get("state")}}.Encode())
+		require.NoError(t, err)
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		assert.Contains(t, string(body), "login complete")
+	}()
+	token, err := flow.LoopbackLogin(context.Background(), Prompt{Out: urls}, "http://127.0.0.1/callback")
+	require.NoError(t, err)
+	assert.Equal(t, "the_refresh_token", token.RefreshToken)
+
+	_, err = flow.LoopbackLogin(context.Background(), Prompt{Out: urls}, "https://zat.example.com/oauth/google")
+	assert.True(t, errors.Is(err, ErrNotLoopback), err)
+}
+
+func TestPastedCode(t *testing.T) {
+	for _, tc := range []struct {
+		pasted string
+		code   string
+		err    string
+	}{
+		{pasted: "the_code", code: "the_code"},
+		{pasted: "http://localhost:8080/oauth/google?state=s&code=the_code&scope=x", code: "the_code"},
+		{pasted: "state=s&code=the_code", code: "the_code"},
+		{pasted: "http://localhost:8080/oauth/google?state=other&code=the_code", err: ErrStateMismatch.Error()},
+		{pasted: "http://localhost:8080/oauth/google?error=access_denied&state=s", err: "access_denied"},
+		{pasted: "", err: "no code provided"},
+	} {
+		code, err := pastedCode(tc.pasted, "s")
+		if tc.err != "" {
+			assert.Error(t, err, tc.pasted)
+			if err != nil {
+				assert.Contains(t, err.Error(), tc.err)
+			}
+			continue
+		}
+		assert.NoError(t, err, tc.pasted)
+		assert.Equal(t, tc.code, code)
+	}
+}
+
+func TestPasteLogin(t *testing.T) {
+	var challenge string
+	redirect := "https://zat.example.com/oauth/google"
+	server := tokenServer(t, &challenge, &redirect)
+	defer server.Close()
+
+	flow := &Flow{Name: "test", PKCE: true, Config: &oauth2.Config{
+		ClientID:    "id",
+		RedirectURL: redirect,
+		Endpoint:    oauth2.Endpoint{AuthURL: "https://provider.example/auth", TokenURL: server.URL},
+	}}
+	urls := make(promptWriter, 1)
+	in := &lazyReader{read: func() string {
+		u := <-urls
+		challenge = u.Query().Get("code_challenge")
+		return redirect + "?code=the_code&state=" + u.Query().Get("state") + "\n"
+	}}
+	token, err := flow.PasteLogin(context.Background(), Prompt{In: in, Out: urls})
+	require.NoError(t, err)
+	assert.Equal(t, "the_access_token", token.AccessToken)
+}
+
+// lazyReader produces its content on first read, once the prompt has been written
+type lazyReader struct {
+	read func() string
+	r    *strings.Reader
+}
+
+func (l *lazyReader) Read(b []byte) (int, error) {
+	if l.r == nil {
+		l.r = strings.NewReader(l.read())
+	}
+	return l.r.Read(b)
+}
@@ -0,0 +1,216 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// ExpiryWindow is how far ahead of expiry tokens are refreshed
+	ExpiryWindow = 5 * time.Minute
+	// RefreshCheckInterval is how often Run checks for tokens about to expire
+	RefreshCheckInterval = time.Minute
+	// RefreshTimeout is how long a refresh may take, other callers wait on it
+	RefreshTimeout = 30 * time.Second
+)
+
+// ErrNoToken is returned when no token has been obtained, ie login is required.
+var ErrNoToken = errors.New("no token, login required")
+
+// TokenSource is a concurrency safe oauth2.TokenSource that refreshes tokens ahead of expiry,
+// persisting them to a Store as they change.
+type TokenSource struct {
+	mu     sync.Mutex
+	logger *log.Logger
+	name   string
+	config *oauth2.Config
+	store  Store
+	// service, when set, issues tokens without a login, see NewServiceTokenSource
+	service func(ctx context.Context) oauth2.TokenSource
+
+	httpClient     *http.Client
+	refreshTimeout time.Duration
+	token          *oauth2.Token
+
+	lastRefresh time.Time
+	lastErr     error
+}
+
+// NewTokenSource creates a token source for config, name is used in log messages.
+func NewTokenSource(logger *log.Logger, name string, config *oauth2.Config) *TokenSource {
+	return &TokenSource{
+		logger:         logger,
+		name:           name,
+		config:         config,
+		httpClient:     http.DefaultClient,
+		refreshTimeout: RefreshTimeout,
+	}
+}
+
+// NewServiceTokenSource creates a token source for credentials that need no login, eg a service account.
+// Tokens are obtained from service rather than by refreshing a stored token, and are not persisted.
+func NewServiceTokenSource(logger *log.Logger, name string, service func(ctx context.Context) oauth2.TokenSource) *TokenSource {
+	ts := NewTokenSource(logger, name, nil)
+	ts.service = service
+	return ts
+}
+
+// SetHTTPClient sets the client used to refresh tokens
+func (ts *TokenSource) SetHTTPClient(httpClient *http.Client) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.httpClient = httpClient
+}
+
+// SetStore persists tokens to store, loading the current token from it.
+func (ts *TokenSource) SetStore(store Store) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.service != nil {
+		// nothing to persist
+		return nil
+	}
+	ts.store = store
+	token, err := store.Load()
+	if err != nil {
+		return err
+	}
+	ts.token = token
+	return nil
+}
+
+// Set replaces the current token, after a login, persisting it. A nil token forgets the current one.
+func (ts *TokenSource) Set(token *oauth2.Token) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.token = token
+	ts.lastErr = nil
+	if token != nil {
+		ts.save()
+	}
+}
+
+// save persists the current token, the lock must be held.
+func (ts *TokenSource) save() {
+	if ts.store == nil {
+		return
+	}
+	if err := ts.store.Save(ts.token); err != nil {
+		ts.logger.Printf("failed to save %s creds: %s", ts.name, err)
+		ts.lastErr = err
+	}
+}
+
+// refresh obtains a new access token, the lock must be held.
+func (ts *TokenSource) refresh(ctx context.Context) error {
+	if ts.token == nil && ts.service == nil {
+		return ErrNoToken
+	}
+	// the lock is held throughout, a stalled provider must not block every caller
+	ctx, cancel := context.WithTimeout(ctx, ts.refreshTimeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, ts.httpClient)
+	var (
+		token *oauth2.Token
+		err   error
+	)
+	if ts.service != nil {
+		token, err = ts.service(ctx).Token()
+	} else {
+		// an empty access token forces a refresh
+		token, err = ts.config.TokenSource(ctx, &oauth2.Token{RefreshToken: ts.token.RefreshToken}).Token()
+	}
+	ts.lastRefresh = time.Now()
+	ts.lastErr = err
+	if err != nil {
+		ts.logger.Printf("error updating %s token: %s", ts.name, err)
+		return err
+	}
+	ts.token = token
+	ts.save()
+	ts.logger.Printf("%s credentials updated and saved", ts.name)
+	return nil
+}
+
+// expiring reports whether the current token needs refreshing, the lock must be held.
+func (ts *TokenSource) expiring() bool {
+	if ts.token == nil {
+		return ts.service != nil
+	}
+	return ts.token.AccessToken == "" || (!ts.token.Expiry.IsZero() && time.Until(ts.token.Expiry) < ExpiryWindow)
+}
+
+// Token returns a valid token, refreshing it first if it is about to expire.
+func (ts *TokenSource) Token() (*oauth2.Token, error) {
+	if ts == nil {
+		return nil, ErrNoToken
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.token == nil && ts.service == nil {
+		return nil, ErrNoToken
+	}
+	if ts.expiring() {
+		if err := ts.refresh(context.Background()); err != nil && (ts.token == nil || !ts.token.Valid()) {
+			return nil, err
+		}
+	}
+	token := *ts.token
+	return &token, nil
+}
+
+// Refresh forces a refresh of the access token, eg when the current one has been rejected.
+func (ts *TokenSource) Refresh(ctx context.Context) error {
+	if ts == nil {
+		return ErrNoToken
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.refresh(ctx)
+}
+
+// Valid reports whether a usable token is available.
+func (ts *TokenSource) Valid() bool {
+	_, err := ts.Token()
+	return err == nil
+}
+
+// Status reports the outcome of the last refresh or persistence attempt.
+func (ts *TokenSource) Status() (time.Time, error) {
+	if ts == nil {
+		return time.Time{}, nil
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.lastRefresh, ts.lastErr
+}
+
+// Run refreshes tokens in the background ahead of expiry until ctx is done.
+// onError, if not nil, is called with each refresh failure.
+func (ts *TokenSource) Run(ctx context.Context, onError func(error)) {
+	ticker := time.NewTicker(RefreshCheckInterval)
+	defer ticker.Stop()
+	for {
+		ts.mu.Lock()
+		var err error
+		if (ts.token != nil || ts.service != nil) && ts.expiring() {
+			err = ts.refresh(ctx)
+		}
+		ts.mu.Unlock()
+		if err != nil && onError != nil {
+			onError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
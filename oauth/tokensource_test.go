@@ -0,0 +1,125 @@
+package oauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestTokenSourceRefresh(t *testing.T) {
+	var refreshes int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&refreshes, 1)
+		assert.Equal(t, "test_refresh_token", r.FormValue("refresh_token"))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "refreshed_access_token",
+			"token_type":   "bearer",
+			"expires_in":   3600,
+		})
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "zat")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store := FileStore{Path: filepath.Join(dir, "creds.json")}
+	require.NoError(t, store.Save(&oauth2.Token{
+		AccessToken:  "expiring_access_token",
+		RefreshToken: "test_refresh_token",
+		Expiry:       time.Now().Add(time.Minute),
+	}))
+
+	var buf bytes.Buffer
+	ts := NewTokenSource(log.New(&buf, "", 0), "test", &oauth2.Config{
+		Endpoint: oauth2.Endpoint{TokenURL: server.URL, AuthStyle: oauth2.AuthStyleInParams},
+	})
+	ts.SetHTTPClient(server.Client())
+	require.NoError(t, ts.SetStore(store))
+
+	// concurrent callers share a single refresh
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := ts.Token()
+			assert.NoError(t, err)
+			assert.Equal(t, "refreshed_access_token", token.AccessToken)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&refreshes))
+
+	// persisted, keeping the refresh token
+	saved, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, "refreshed_access_token", saved.AccessToken)
+	assert.Equal(t, "test_refresh_token", saved.RefreshToken)
+
+	_, err = ts.Status()
+	assert.NoError(t, err)
+}
+
+func TestTokenSourceRefreshFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	ts := NewTokenSource(log.New(&buf, "", 0), "test", &oauth2.Config{
+		Endpoint: oauth2.Endpoint{TokenURL: server.URL, AuthStyle: oauth2.AuthStyleInParams},
+	})
+	ts.SetHTTPClient(server.Client())
+	assert.False(t, ts.Valid())
+
+	// still valid for a few minutes, refresh failure is reported but the token is usable
+	ts.Set(&oauth2.Token{AccessToken: "a", RefreshToken: "r", Expiry: time.Now().Add(2 * time.Minute)})
+	token, err := ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "a", token.AccessToken)
+	_, err = ts.Status()
+	assert.Error(t, err)
+
+	ts.Set(&oauth2.Token{AccessToken: "a", RefreshToken: "r", Expiry: time.Now().Add(-time.Minute)})
+	assert.False(t, ts.Valid())
+}
+
+func TestTokenSourceRefreshTimeout(t *testing.T) {
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stalled
+	}))
+	defer server.Close()
+	defer close(stalled)
+
+	var buf bytes.Buffer
+	ts := NewTokenSource(log.New(&buf, "", 0), "test", &oauth2.Config{
+		Endpoint: oauth2.Endpoint{TokenURL: server.URL, AuthStyle: oauth2.AuthStyleInParams},
+	})
+	ts.SetHTTPClient(server.Client())
+	ts.refreshTimeout = 50 * time.Millisecond
+	ts.Set(&oauth2.Token{AccessToken: "a", RefreshToken: "r", Expiry: time.Now().Add(-time.Minute)})
+
+	// a stalled provider gives up rather than holding the lock forever
+	start := time.Now()
+	_, err := ts.Token()
+	assert.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	_, err = ts.Status()
+	assert.Error(t, err)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.elastic.co/apm"
+
+	"github.com/graphaelli/zat/zoom"
+)
+
+const (
+	participantsCSV  = "csv"
+	participantsJSON = "json"
+
+	defaultSlackMessage = "{{.Meeting.Topic}} recording now available: {{.FolderURL}}"
+)
+
+// meetingParticipants lists everyone that attended a meeting.
+// The participants report includes attendance times but requires a paid plan,
+// fall back to the past meeting participants list when it is unavailable.
+func (z *Config) meetingParticipants(ctx context.Context, meeting zoom.Meeting) ([]zoom.Participant, error) {
+	span, ctx := apm.StartSpan(ctx, "meetingParticipants", "app")
+	defer span.End()
+
+	list := z.zoomClient.ListMeetingParticipantsReport
+	fellBack := false
+	var participants []zoom.Participant
+	nextPageToken := ""
+	for {
+		rsp, err := list(ctx, meeting.UUID, nextPageToken)
+		if err != nil {
+			// only fall back when the report is unavailable, not when zoom is
+			var apiErr *zoom.APIError
+			if fellBack || participants != nil || (errors.As(err, &apiErr) && apiErr.Temporary()) {
+				return nil, err
+			}
+			fellBack = true
+			z.logger.Printf("participants report unavailable for %q, falling back to participant list: %s", meeting.Topic, err)
+			list = z.zoomClient.ListPastMeetingParticipants
+			nextPageToken = ""
+			continue
+		}
+		participants = append(participants, rsp.Participants...)
+		nextPageToken = rsp.NextPageToken
+		if nextPageToken == "" {
+			return participants, nil
+		}
+	}
+}
+
+// participantNames returns the sorted, unique names of attendees.
+func participantNames(participants []zoom.Participant) []string {
+	seen := make(map[string]bool, len(participants))
+	names := make([]string, 0, len(participants))
+	for _, p := range participants {
+		if p.Name == "" || seen[p.Name] {
+			continue
+		}
+		seen[p.Name] = true
+		names = append(names, p.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// attendance is a single session of a participant in a meeting, as archived.
+type attendance struct {
+	Name      string     `json:"name"`
+	Email     string     `json:"email,omitempty"`
+	JoinTime  *time.Time `json:"join_time,omitempty"`
+	LeaveTime *time.Time `json:"leave_time,omitempty"`
+	Duration  int        `json:"duration_seconds,omitempty"`
+}
+
+func attendances(participants []zoom.Participant) []attendance {
+	a := make([]attendance, len(participants))
+	for i, p := range participants {
+		a[i] = attendance{Name: p.Name, Email: p.UserEmail, Duration: p.Duration}
+		if !p.JoinTime.IsZero() {
+			join := p.JoinTime
+			a[i].JoinTime = &join
+		}
+		if !p.LeaveTime.IsZero() {
+			leave := p.LeaveTime
+			a[i].LeaveTime = &leave
+		}
+	}
+	return a
+}
+
+// participantsReport renders the attendance of a meeting in the requested format.
+func participantsReport(format string, participants []zoom.Participant) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case participantsCSV:
+		w := csv.NewWriter(&buf)
+		if err := w.Write([]string{"name", "email", "join_time", "leave_time", "duration_seconds"}); err != nil {
+			return nil, err
+		}
+		for _, a := range attendances(participants) {
+			record := []string{a.Name, a.Email, "", "", ""}
+			if a.JoinTime != nil {
+				record[2] = a.JoinTime.Format(time.RFC3339)
+			}
+			if a.LeaveTime != nil {
+				record[3] = a.LeaveTime.Format(time.RFC3339)
+			}
+			if a.Duration != 0 {
+				record[4] = strconv.Itoa(a.Duration)
+			}
+			if err := w.Write(record); err != nil {
+				return nil, err
+			}
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return nil, err
+		}
+	case participantsJSON:
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(attendances(participants)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown participants format %q", format)
+	}
+	return buf.Bytes(), nil
+}
+
+// participantsFileName constructs the name of the attendance report for this meeting
+func participantsFileName(meeting zoom.Meeting, format string) string {
+	return fmt.Sprintf("%s %s.participants.%s", meeting.StartTime.Format("2006-01-02-150405"), meeting.Topic, format)
+}
+
+// notification is the data available to slack message templates.
+type notification struct {
+	Meeting          zoom.Meeting
+	FolderURL        string
+	Participants     []zoom.Participant
+	ParticipantCount int
+	ParticipantNames []string
+}
+
+func parseSlackMessage(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultSlackMessage
+	}
+	return template.New("slack").Funcs(template.FuncMap{"join": strings.Join}).Parse(text)
+}
+
+func (n notification) render(text string) (string, error) {
+	tmpl, err := parseSlackMessage(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, n); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
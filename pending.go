@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/graphaelli/zat/atomicfile"
+	"github.com/graphaelli/zat/zoom"
+)
+
+const (
+	recordingCompleted = "completed"
+	// pendingTTL is how long recordings are waited on before giving up
+	pendingTTL = 7 * 24 * time.Hour
+)
+
+// isProcessing reports whether zoom is still processing f, files without a status are assumed complete
+func isProcessing(f zoom.RecordingFile) bool {
+	return f.Status != "" && !strings.EqualFold(f.Status, recordingCompleted)
+}
+
+// isPreferred reports whether slack notifications wait for f to be archived
+func isPreferred(f zoom.RecordingFile) bool {
+	return strings.ToLower(f.FileType) == "mp4"
+}
+
+type pendingFile struct {
+	ID       string `json:"id"`
+	FileType string `json:"file_type"`
+	Status   string `json:"status"`
+}
+
+// pendingMeeting is a meeting with recording files zoom was still processing when last archived
+type pendingMeeting struct {
+	UUID      string        `json:"uuid"`
+	ID        int64         `json:"id"`
+	Topic     string        `json:"topic"`
+	StartTime time.Time     `json:"start_time"`
+	Files     []pendingFile `json:"files"`
+	FirstSeen time.Time     `json:"first_seen"`
+}
+
+// pendingRecordings persists meetings to recheck on later runs
+type pendingRecordings struct {
+	mu       sync.Mutex
+	path     string
+	meetings map[string]*pendingMeeting
+}
+
+func newPending(path string) *pendingRecordings {
+	return &pendingRecordings{path: path, meetings: make(map[string]*pendingMeeting)}
+}
+
+// loadPending reads pending recordings from path, a missing file has none
+func loadPending(path string) (*pendingRecordings, error) {
+	p := newPending(path)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return nil, err
+	}
+	var meetings []*pendingMeeting
+	if err := json.Unmarshal(b, &meetings); err != nil {
+		return nil, err
+	}
+	for _, m := range meetings {
+		p.meetings[m.UUID] = m
+	}
+	return p, nil
+}
+
+// set records the files of meeting still processing, none removes the meeting
+func (p *pendingRecordings) set(meeting zoom.Meeting, files []zoom.RecordingFile) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(files) == 0 {
+		delete(p.meetings, meeting.UUID)
+		return
+	}
+	m, ok := p.meetings[meeting.UUID]
+	if !ok {
+		m = &pendingMeeting{
+			UUID:      meeting.UUID,
+			ID:        meeting.ID,
+			Topic:     meeting.Topic,
+			StartTime: meeting.StartTime,
+			FirstSeen: time.Now(),
+		}
+		p.meetings[meeting.UUID] = m
+	}
+	m.Files = m.Files[:0]
+	for _, f := range files {
+		m.Files = append(m.Files, pendingFile{ID: f.ID, FileType: f.FileType, Status: f.Status})
+	}
+}
+
+// list returns the pending meetings, oldest first
+func (p *pendingRecordings) list() []pendingMeeting {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	meetings := make([]pendingMeeting, 0, len(p.meetings))
+	for _, m := range p.meetings {
+		meetings = append(meetings, *m)
+	}
+	sort.Slice(meetings, func(i, j int) bool { return meetings[i].StartTime.Before(meetings[j].StartTime) })
+	return meetings
+}
+
+// expire gives up on meetings pending since before cutoff, returning them
+func (p *pendingRecordings) expire(cutoff time.Time) []pendingMeeting {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var expired []pendingMeeting
+	for uuid, m := range p.meetings {
+		if m.FirstSeen.Before(cutoff) {
+			expired = append(expired, *m)
+			delete(p.meetings, uuid)
+		}
+	}
+	return expired
+}
+
+// save persists pending recordings, replacing the file atomically
+func (p *pendingRecordings) save() error {
+	meetings := p.list()
+	b, err := json.MarshalIndent(meetings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(p.path, b)
+}
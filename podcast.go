@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.elastic.co/apm"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+
+	"github.com/graphaelli/zat/google"
+)
+
+const (
+	podcastFileName = "podcast.xml"
+	// podcastFormat tags the feed written to the destination folder
+	podcastFormat = "podcast.xml"
+
+	podcastFields googleapi.Field = "nextPageToken, files(id, name, size, createdTime, appProperties)"
+)
+
+// Podcast configures the podcast feed of a directive's audio recordings
+type Podcast struct {
+	// Title of the feed, defaulting to the directive name
+	Title string `json:"title,omitempty"`
+	// Token authenticates podcast apps, which can't sign in. It is included in feed and episode URLs.
+	Token string `json:"token,omitempty"`
+	// Drive also keeps the feed in the destination folder, which requires -public-url
+	Drive bool `json:"drive,omitempty"`
+}
+
+func (p *Podcast) validate() error {
+	if p.Token != "" && len(p.Token) < 16 {
+		return errors.New("token is too short, use at least 16 characters")
+	}
+	return nil
+}
+
+// podcastPath is the path of the feed of meetingID, or of an episode in it when fileID is set
+func podcastPath(meetingID int64, fileID string) string {
+	if fileID == "" {
+		return fmt.Sprintf("/podcast/%d.xml", meetingID)
+	}
+	return fmt.Sprintf("/podcast/%d/%s.m4a", meetingID, fileID)
+}
+
+// podcastURL is the absolute URL of podcastPath, including the feed token
+func podcastURL(base *url.URL, p *Podcast, meetingID int64, fileID string) string {
+	u := *base
+	u.Path = strings.TrimSuffix(u.Path, "/") + podcastPath(meetingID, fileID)
+	if p.Token != "" {
+		u.RawQuery = url.Values{"token": {p.Token}}.Encode()
+	}
+	return u.String()
+}
+
+// parsePodcastPath splits a podcast request path into its meeting ID and, for episodes, file ID
+func parsePodcastPath(p string) (meetingID int64, fileID string, ok bool) {
+	rest := strings.TrimPrefix(p, "/podcast/")
+	var id string
+	switch parts := strings.Split(rest, "/"); {
+	case rest == p:
+		return 0, "", false
+	case len(parts) == 1 && strings.HasSuffix(rest, ".xml"):
+		id = strings.TrimSuffix(rest, ".xml")
+	case len(parts) == 2 && strings.HasSuffix(parts[1], ".m4a") && parts[1] != ".m4a":
+		id, fileID = parts[0], strings.TrimSuffix(parts[1], ".m4a")
+	default:
+		return 0, "", false
+	}
+	meetingID, err := strconv.ParseInt(id, 10, 64)
+	return meetingID, fileID, err == nil
+}
+
+// episodeQuery finds the audio recordings archived for meetingID
+func episodeQuery(meetingID int64) string {
+	return propertiesQuery(map[string]string{
+		propMeetingID: strconv.FormatInt(meetingID, 10),
+		propFileType:  "m4a",
+	}) + " and trashed=false"
+}
+
+// isEpisode reports whether file is an audio recording archived for meetingID, or extracted from one, rather than a conversion
+func isEpisode(file *drive.File, meetingID int64) bool {
+	format := file.AppProperties[propFormat]
+	return file.AppProperties[propMeetingID] == strconv.FormatInt(meetingID, 10) &&
+		file.AppProperties[propFileType] == "m4a" && (format == "" || format == transcodeAudio)
+}
+
+// listEpisodes finds the audio recordings archived for meetingID, in any folder
+func listEpisodes(ctx context.Context, gdrive *google.Drive, meetingID int64) ([]*drive.File, error) {
+	span, ctx := apm.StartSpan(ctx, "listEpisodes", "app")
+	defer span.End()
+
+	var episodes []*drive.File
+	nextPageToken := ""
+	for {
+		list, err := gdrive.ListFiles(ctx, episodeQuery(meetingID), nextPageToken, podcastFields)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range list.Files {
+			if isEpisode(f, meetingID) {
+				episodes = append(episodes, f)
+			}
+		}
+		if list.NextPageToken == "" {
+			return episodes, nil
+		}
+		nextPageToken = list.NextPageToken
+	}
+}
+
+// episodeTitle derives the title and date of an episode from its name, as given by recordingFileName
+func episodeTitle(file *drive.File) (string, time.Time) {
+	name := strings.TrimSuffix(file.Name, path.Ext(file.Name))
+	const layout = "2006-01-02-150405"
+	if len(name) > len(layout)+1 && name[len(layout)] == ' ' {
+		if start, err := time.Parse(layout, name[:len(layout)]); err == nil {
+			topic := name[len(layout)+1:]
+			return fmt.Sprintf("%s %s", topic, start.Format("2006-01-02 15:04")), start
+		}
+	}
+	// renamed in drive, use when it was archived
+	created, _ := time.Parse(time.RFC3339, file.CreatedTime)
+	return name, created
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	ITunes  string     `xml:"xmlns:itunes,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	Description string `xml:"description"`
+	// Block keeps the feed out of podcast directories
+	Block string    `xml:"itunes:block"`
+	Items []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title     string       `xml:"title"`
+	GUID      rssGUID      `xml:"guid"`
+	PubDate   string       `xml:"pubDate"`
+	Enclosure rssEnclosure `xml:"enclosure"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// podcastFeed renders the feed of episodes archived by action for meetingID, newest first,
+// with enclosures proxied by zat at base.
+func podcastFeed(action Directive, meetingID int64, episodes []*drive.File, base *url.URL) ([]byte, error) {
+	title := action.Podcast.Title
+	if title == "" {
+		title = action.Name
+	}
+	feed := rssFeed{
+		Version: "2.0",
+		ITunes:  "http://www.itunes.com/dtds/podcast-1.0.dtd",
+		Channel: rssChannel{
+			Title:       title,
+			Link:        podcastURL(base, action.Podcast, meetingID, ""),
+			Description: fmt.Sprintf("Audio recordings of %s, archived by zat", action.Name),
+			Block:       "yes",
+		},
+	}
+	type episode struct {
+		item  rssItem
+		start time.Time
+	}
+	items := make([]episode, len(episodes))
+	for i, f := range episodes {
+		title, start := episodeTitle(f)
+		items[i] = episode{start: start, item: rssItem{
+			Title:   title,
+			GUID:    rssGUID{Value: f.Id},
+			PubDate: start.Format(time.RFC1123Z),
+			Enclosure: rssEnclosure{
+				URL: podcastURL(base, action.Podcast, meetingID, f.Id),
+				// the size of the zoom recording file, archived unchanged
+				Length: f.Size,
+				Type:   "audio/mp4",
+			},
+		}}
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].start.After(items[j].start) })
+	for _, e := range items {
+		feed.Channel.Items = append(feed.Channel.Items, e.item)
+	}
+	b, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(b, '\n')...), nil
+}
+
+// podcastBase is where zat is reached for links in served feeds, -public-url or else the URL r was made to
+func (z *Config) podcastBase(r *http.Request) *url.URL {
+	if z.publicURL != "" {
+		if base, err := url.Parse(z.publicURL); err == nil {
+			return base
+		}
+	}
+	return requestBase(r)
+}
+
+// requestBase is the URL zat was reached at by r
+func requestBase(r *http.Request) *url.URL {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return &url.URL{Scheme: scheme, Host: r.Host}
+}
+
+// podcastHandler serves the feeds of directives with podcasts, and proxies their episodes from drive.
+// Requests presenting the feed token are allowed, otherwise viewers are.
+func (z *Config) podcastHandler(auth *webAuth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		meetingID, fileID, ok := parsePodcastPath(r.URL.Path)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		action, ok := z.copies[meetingID]
+		if !ok || action.skip() || action.Podcast == nil {
+			http.NotFound(w, r)
+			return
+		}
+		serve := func(w http.ResponseWriter, r *http.Request) {
+			if fileID == "" {
+				z.serveFeed(w, r, action, meetingID)
+			} else {
+				z.serveEpisode(w, r, meetingID, fileID)
+			}
+		}
+		if token := action.Podcast.Token; token != "" && subtle.ConstantTimeCompare([]byte(r.FormValue("token")), []byte(token)) == 1 {
+			serve(w, r)
+			return
+		}
+		auth.require(roleViewer, serve)(w, r)
+	}
+}
+
+func (z *Config) serveFeed(w http.ResponseWriter, r *http.Request, action Directive, meetingID int64) {
+	gdrive, err := z.googleClient.Drive(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	episodes, err := listEpisodes(r.Context(), gdrive, meetingID)
+	if err != nil {
+		z.logger.Printf("failed to list episodes of %q: %s", action.Name, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	feed, err := podcastFeed(action, meetingID, episodes, z.podcastBase(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Write(feed)
+}
+
+// serveEpisode proxies an archived audio recording, passing through range requests, which podcast apps rely on
+func (z *Config) serveEpisode(w http.ResponseWriter, r *http.Request, meetingID int64, fileID string) {
+	gdrive, err := z.googleClient.Drive(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// only recordings of this meeting are served, not any file zat can read
+	file, err := gdrive.GetFile(r.Context(), fileID, "id, trashed, appProperties")
+	var apiErr *googleapi.Error
+	if err != nil {
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		z.logger.Printf("failed to get episode %s: %s", fileID, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if file.Trashed || !isEpisode(file, meetingID) {
+		http.NotFound(w, r)
+		return
+	}
+	rsp, err := gdrive.Download(r.Context(), fileID, r.Header.Get("Range"))
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusRequestedRangeNotSatisfiable {
+		http.Error(w, apiErr.Message, apiErr.Code)
+		return
+	} else if err != nil {
+		z.logger.Printf("failed to download episode %s: %s", fileID, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer rsp.Body.Close()
+	for _, h := range []string{"Content-Length", "Content-Range", "Last-Modified", "ETag"} {
+		if v := rsp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.Header().Set("Content-Type", "audio/mp4")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.WriteHeader(rsp.StatusCode)
+	if r.Method != http.MethodHead {
+		io.Copy(w, rsp.Body)
+	}
+}
+
+// archivePodcast writes the feed of action to its destination folder, updating it as episodes are archived
+func (z *Config) archivePodcast(ctx context.Context, gdrive *google.Drive, parent *drive.File, meetingID int64, action Directive) error {
+	span, ctx := apm.StartSpan(ctx, "archivePodcast", "app")
+	defer span.End()
+
+	if z.publicURL == "" {
+		return fmt.Errorf("podcast feed of %q not written to drive, -public-url is required", action.Name)
+	}
+	base, err := url.Parse(z.publicURL)
+	if err != nil {
+		return fmt.Errorf("while parsing -public-url: %w", err)
+	}
+	episodes, err := listEpisodes(ctx, gdrive, meetingID)
+	if err != nil {
+		return fmt.Errorf("while listing episodes: %w", err)
+	}
+	feed, err := podcastFeed(action, meetingID, episodes, base)
+	if err != nil {
+		return err
+	}
+
+	props := map[string]string{propMeetingID: strconv.FormatInt(meetingID, 10), propFormat: podcastFormat}
+	existing, err := gdrive.ListFiles(ctx, fmt.Sprintf("%q in parents and trashed=false and %s", parent.Id, propertiesQuery(props)), "", sidecarFields)
+	if err != nil {
+		return fmt.Errorf("while finding %s: %w", podcastFileName, err)
+	}
+	var current *drive.File
+	if len(existing.Files) > 0 {
+		current = existing.Files[0]
+	}
+	return z.writeSidecar(ctx, gdrive, parent, current, &drive.File{Name: podcastFileName, AppProperties: props}, feed, "application/rss+xml")
+}
+
+// podcasts lists the meeting IDs of directives with podcasts
+func (z *Config) podcasts() []int64 {
+	var ids []int64
+	for id, action := range z.copies {
+		if action.Podcast != nil && !action.skip() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.elastic.co/apm"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+
+	"github.com/graphaelli/zat/google"
+	"github.com/graphaelli/zat/zoom"
+)
+
+// appProperties tag archived folders and files with their zoom origin,
+// so they are recognized regardless of their names.
+// https://developers.google.com/drive/api/v3/properties
+const (
+	propMeetingUUID = "zatMeetingUUID"
+	propMeetingID   = "zatMeetingID"
+	propRecordingID = "zatRecordingID"
+	propFileType    = "zatFileType"
+	// propFormat distinguishes conversions from the zoom original, which has none
+	propFormat   = "zatFormat"
+	propChecksum = "zatChecksum"
+)
+
+// fileFields are the fields needed to recognize archived files
+const fileFields googleapi.Field = "nextPageToken, files(id, name, mimeType, createdTime, appProperties)"
+
+func folderProperties(meeting zoom.Meeting) map[string]string {
+	return map[string]string{
+		propMeetingUUID: meeting.UUID,
+		propMeetingID:   strconv.FormatInt(meeting.ID, 10),
+	}
+}
+
+// fileProperties tags a file archived from recording f, format is empty for the zoom original.
+func fileProperties(meeting zoom.Meeting, f zoom.RecordingFile, format string) map[string]string {
+	props := folderProperties(meeting)
+	if f.ID != "" {
+		props[propRecordingID] = f.ID
+	}
+	if f.FileType != "" {
+		props[propFileType] = strings.ToLower(f.FileType)
+	}
+	if format != "" {
+		props[propFormat] = format
+	}
+	return props
+}
+
+// participantsProperties tags a participants report, which has no recording
+func participantsProperties(meeting zoom.Meeting, format string) map[string]string {
+	return fileProperties(meeting, zoom.RecordingFile{}, "participants."+format)
+}
+
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// propertiesQuery matches files with all of props
+func propertiesQuery(props map[string]string) string {
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	clauses := make([]string, len(keys))
+	for i, k := range keys {
+		clauses[i] = fmt.Sprintf("appProperties has { key=%q and value=%q }", k, props[k])
+	}
+	return strings.Join(clauses, " and ")
+}
+
+func archivedKey(recordingID, format string) string {
+	return recordingID + "/" + format
+}
+
+// archived tracks what has already been archived to a meeting folder
+type archived struct {
+	keys map[string]bool
+	// names of untagged files, archived before files were tagged
+	names map[string]bool
+}
+
+func (a archived) add(file *drive.File) {
+	if file.AppProperties[propMeetingUUID] == "" {
+		a.names[file.Name] = true
+		return
+	}
+	a.keys[archivedKey(file.AppProperties[propRecordingID], file.AppProperties[propFormat])] = true
+}
+
+// has reports whether the recording in format has been archived, by its tags or by name for untagged files
+func (a archived) has(props map[string]string, name string) bool {
+	return a.keys[archivedKey(props[propRecordingID], props[propFormat])] || a.names[name]
+}
+
+// listFolder lists the files of meeting in folder with fields.
+// Untagged files are only listed in folders that predate tagging.
+func listFolder(ctx context.Context, gdrive *google.Drive, folder *drive.File, meeting zoom.Meeting, fields googleapi.Field) ([]*drive.File, error) {
+	query := fmt.Sprintf("%q in parents and trashed=false", folder.Id)
+	if folder.AppProperties[propMeetingUUID] != "" {
+		query += " and " + propertiesQuery(map[string]string{propMeetingUUID: meeting.UUID})
+	}
+	var files []*drive.File
+	nextPageToken := ""
+	for {
+		list, err := gdrive.ListFiles(ctx, query, nextPageToken, fields)
+		if err != nil {
+			return files, err
+		}
+		files = append(files, list.Files...)
+		if list.NextPageToken == "" {
+			return files, nil
+		}
+		nextPageToken = list.NextPageToken
+	}
+}
+
+// listArchived finds the files archived for meeting in folder.
+func listArchived(ctx context.Context, gdrive *google.Drive, folder *drive.File, meeting zoom.Meeting) (archived, error) {
+	span, ctx := apm.StartSpan(ctx, "listArchived", "app")
+	defer span.End()
+
+	a := archived{keys: make(map[string]bool), names: make(map[string]bool)}
+	files, err := listFolder(ctx, gdrive, folder, meeting, fileFields)
+	for _, f := range files {
+		a.add(f)
+	}
+	return a, err
+}
+
+// expectedProperties maps the names zat may have archived files of meeting as to their tags
+func expectedProperties(meeting zoom.Meeting) map[string]map[string]string {
+	expected := make(map[string]map[string]string)
+	for _, f := range meeting.RecordingFiles {
+		name := recordingFileName(meeting, f)
+		expected[name] = fileProperties(meeting, f, "")
+		switch {
+		case isTranscript(f):
+			for _, format := range []string{transcriptDoc, transcriptText, transcriptMarkdown} {
+				expected[transcriptFileName(name, format)] = fileProperties(meeting, f, format)
+			}
+		case isChat(f):
+			for _, format := range []string{chatDoc, chatHTML} {
+				expected[chatFileName(name, format)] = fileProperties(meeting, f, format)
+			}
+		}
+	}
+	for _, format := range []string{participantsCSV, participantsJSON} {
+		expected[participantsFileName(meeting, format)] = participantsProperties(meeting, format)
+	}
+	return expected
+}
+
+// MigrateProperties tags folders and files archived before tagging, matching them by name.
+func (z *Config) MigrateProperties(ctx context.Context, since time.Duration) error {
+	release, err := z.lock(ctx)
+	if err != nil {
+		return fmt.Errorf("migration skipped: %w", err)
+	}
+	defer release()
+
+	gdrive, err := z.googleClient.Drive(ctx)
+	if err != nil {
+		return fmt.Errorf("while creating gdrive client: %w", err)
+	}
+	z.loadFolders(ctx, gdrive)
+	defer z.saveFolders()
+
+	nextPageToken := ""
+	for {
+		recordings, err := z.zoomClient.ListRecordings(ctx, time.Now().Add(-1*since), nextPageToken)
+		if err != nil {
+			return fmt.Errorf("failed to list recordings: %w", err)
+		}
+		for _, meeting := range recordings.Meetings {
+			if err := z.migrateMeeting(ctx, gdrive, meeting); err != nil {
+				z.logger.Print(err)
+			}
+		}
+		nextPageToken = recordings.NextPageToken
+		if nextPageToken == "" {
+			return nil
+		}
+	}
+}
+
+func (z *Config) migrateMeeting(ctx context.Context, gdrive *google.Drive, meeting zoom.Meeting) error {
+	action := z.copies[meeting.ID]
+	if action.skip() || action.Google == "" {
+		return nil
+	}
+	parent, err := z.destinationFolder(ctx, gdrive, action)
+	if err != nil {
+		return fmt.Errorf("directive %q: while finding parent of %q: %w", action.Name, action.Google, err)
+	}
+	name := meetingFolderName(meeting)
+	query := fmt.Sprintf("mimeType=%q and %q in parents and name=%q and trashed=false", google.MimeTypeFolder, parent.Id, name)
+	folders, err := gdrive.ListFiles(ctx, query, "", fileFields)
+	if err != nil {
+		return fmt.Errorf("directive %q: while finding meeting folder %q: %w", action.Name, name, err)
+	}
+	if len(folders.Files) != 1 {
+		z.logger.Printf("skipping migration of %q, %d folders named %q", meeting.Topic, len(folders.Files), name)
+		return nil
+	}
+	folder := folders.Files[0]
+
+	expected := expectedProperties(meeting)
+	nextPageToken := ""
+	for {
+		files, err := gdrive.ListFiles(ctx, fmt.Sprintf("%q in parents and trashed=false", folder.Id), nextPageToken, fileFields)
+		if err != nil {
+			return fmt.Errorf("directive %q: while listing meeting folder %q: %w", action.Name, name, err)
+		}
+		for _, f := range files.Files {
+			props, ok := expected[f.Name]
+			if !ok || f.AppProperties[propMeetingUUID] != "" {
+				continue
+			}
+			if _, err := gdrive.UpdateFile(ctx, f.Id, &drive.File{AppProperties: props}); err != nil {
+				return fmt.Errorf("directive %q: while tagging %q: %w", action.Name, f.Name, err)
+			}
+			z.logger.Printf("tagged %s/%s", name, f.Name)
+		}
+		if files.NextPageToken == "" {
+			break
+		}
+		nextPageToken = files.NextPageToken
+	}
+
+	// tag the folder last, once tagged its untagged files are no longer recognized
+	if folder.AppProperties[propMeetingUUID] == "" {
+		if _, err := gdrive.UpdateFile(ctx, folder.Id, &drive.File{AppProperties: folderProperties(meeting)}); err != nil {
+			return fmt.Errorf("directive %q: while tagging folder %q: %w", action.Name, name, err)
+		}
+		z.logger.Printf("tagged folder %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+// Package search indexes archived transcripts and chat logs for full text search.
+//
+// Documents are persisted as JSON, the inverted index is rebuilt in memory when loaded,
+// which is fast enough for the transcripts of a few thousand meetings.
+package search
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/graphaelli/zat/atomicfile"
+)
+
+// Entry is a searchable passage of a document, a transcript paragraph or chat message
+type Entry struct {
+	// Offset is the time of the entry, relative to the start of the recording
+	Offset  time.Duration `json:"offset"`
+	Speaker string        `json:"speaker,omitempty"`
+	Text    string        `json:"text"`
+}
+
+// Document is an archived transcript or chat log
+type Document struct {
+	// ID identifies the document, adding a document with the same ID replaces it.
+	ID          string    `json:"id"`
+	MeetingUUID string    `json:"meeting_uuid"`
+	MeetingID   int64     `json:"meeting_id"`
+	Topic       string    `json:"topic"`
+	Start       time.Time `json:"start"`
+	// Kind is the zoom file type, eg transcript or chat
+	Kind string `json:"kind"`
+	// RecordingStart is when the recording the entries are relative to started
+	RecordingStart time.Time `json:"recording_start"`
+	// ShareURL is the zoom recording, FolderURL where it was archived
+	ShareURL  string  `json:"share_url,omitempty"`
+	FolderURL string  `json:"folder_url,omitempty"`
+	Entries   []Entry `json:"entries"`
+}
+
+// Result is an entry matching a query
+type Result struct {
+	Document *Document `json:"-"`
+	Entry    Entry     `json:"entry"`
+	// Snippet is the part of the entry text around the first match
+	Snippet string  `json:"snippet"`
+	Score   float64 `json:"score"`
+}
+
+// posting locates an entry containing a term
+type posting struct {
+	doc   string
+	entry int
+}
+
+// Index is a full text index of documents, safe for concurrent use
+type Index struct {
+	mu   sync.Mutex
+	path string
+	// loaded is the modification time of path when it was last read or written
+	loaded time.Time
+	dirty  bool
+	docs   map[string]*Document
+	terms  map[string][]posting
+}
+
+// New creates an empty index persisted at path, nothing is read until Refresh
+func New(path string) *Index {
+	return &Index{path: path, docs: make(map[string]*Document), terms: make(map[string][]posting)}
+}
+
+// Open reads the index persisted at path, a missing file is an empty index
+func Open(path string) (*Index, error) {
+	ix := New(path)
+	return ix, ix.Refresh()
+}
+
+// Refresh reads the index again when another process has saved it since, unless there are unsaved changes
+func (ix *Index) Refresh() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.path == "" || ix.dirty {
+		return nil
+	}
+	info, err := os.Stat(ix.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !info.ModTime().After(ix.loaded) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(ix.path)
+	if err != nil {
+		return err
+	}
+	var docs []*Document
+	if err := json.Unmarshal(b, &docs); err != nil {
+		return err
+	}
+	ix.docs = make(map[string]*Document, len(docs))
+	ix.terms = make(map[string][]posting)
+	for _, doc := range docs {
+		ix.add(doc)
+	}
+	ix.loaded = info.ModTime()
+	return nil
+}
+
+// Save persists the index when changed, replacing the file atomically
+func (ix *Index) Save() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.path == "" || !ix.dirty {
+		return nil
+	}
+	docs := make([]*Document, 0, len(ix.docs))
+	for _, doc := range ix.docs {
+		docs = append(docs, doc)
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].ID < docs[j].ID })
+	b, err := json.Marshal(docs)
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(ix.path, b); err != nil {
+		return err
+	}
+	if info, err := os.Stat(ix.path); err == nil {
+		ix.loaded = info.ModTime()
+	}
+	ix.dirty = false
+	return nil
+}
+
+// Add indexes doc, replacing any document with the same ID
+func (ix *Index) Add(doc Document) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if _, exists := ix.docs[doc.ID]; exists {
+		ix.remove(doc.ID)
+	}
+	ix.add(&doc)
+	ix.dirty = true
+}
+
+// Has reports whether the document id is indexed
+func (ix *Index) Has(id string) bool {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	_, ok := ix.docs[id]
+	return ok
+}
+
+// Len is the number of documents indexed
+func (ix *Index) Len() int {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return len(ix.docs)
+}
+
+func (ix *Index) add(doc *Document) {
+	ix.docs[doc.ID] = doc
+	for i, e := range doc.Entries {
+		seen := make(map[string]bool)
+		for _, term := range Terms(e.Speaker + " " + e.Text) {
+			if !seen[term] {
+				seen[term] = true
+				ix.terms[term] = append(ix.terms[term], posting{doc: doc.ID, entry: i})
+			}
+		}
+	}
+}
+
+func (ix *Index) remove(id string) {
+	delete(ix.docs, id)
+	for term, postings := range ix.terms {
+		kept := postings[:0]
+		for _, p := range postings {
+			if p.doc != id {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) == 0 {
+			delete(ix.terms, term)
+		} else {
+			ix.terms[term] = kept
+		}
+	}
+}
+
+// Terms splits text into lower case words for indexing and querying
+func Terms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Search finds entries containing all terms of query, best matches first, at most limit when positive.
+// Entries score higher the more often the terms occur in them, ties are broken by the newest meeting.
+func (ix *Index) Search(query string, limit int) []Result {
+	terms := Terms(query)
+	if len(terms) == 0 {
+		return nil
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	// intersect postings, starting from the rarest term
+	sort.Slice(terms, func(i, j int) bool { return len(ix.terms[terms[i]]) < len(ix.terms[terms[j]]) })
+	matches := make(map[posting]bool)
+	for _, p := range ix.terms[terms[0]] {
+		matches[p] = true
+	}
+	for _, term := range terms[1:] {
+		next := make(map[posting]bool)
+		for _, p := range ix.terms[term] {
+			if matches[p] {
+				next[p] = true
+			}
+		}
+		matches = next
+	}
+
+	results := make([]Result, 0, len(matches))
+	for p := range matches {
+		doc := ix.docs[p.doc]
+		entry := doc.Entries[p.entry]
+		results = append(results, Result{
+			Document: doc,
+			Entry:    entry,
+			Snippet:  snippet(entry.Text, terms),
+			Score:    score(entry, terms),
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if !a.Document.Start.Equal(b.Document.Start) {
+			return a.Document.Start.After(b.Document.Start)
+		}
+		if a.Document.ID != b.Document.ID {
+			return a.Document.ID < b.Document.ID
+		}
+		return a.Entry.Offset < b.Entry.Offset
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// score counts occurrences of terms in entry, relative to its length so passages dense with matches rank first
+func score(entry Entry, terms []string) float64 {
+	want := make(map[string]bool, len(terms))
+	for _, t := range terms {
+		want[t] = true
+	}
+	words := Terms(entry.Speaker + " " + entry.Text)
+	hits := 0
+	for _, w := range words {
+		if want[w] {
+			hits++
+		}
+	}
+	return float64(hits) / (1 + float64(len(words))/50)
+}
+
+// snippetLength is the approximate length of snippets, in bytes
+const snippetLength = 160
+
+// snippet is the part of text around the first match of terms, on word boundaries
+func snippet(text string, terms []string) string {
+	if len(text) <= snippetLength {
+		return text
+	}
+	lower := strings.ToLower(text)
+	first := -1
+	for _, term := range terms {
+		if i := strings.Index(lower, term); i >= 0 && (first < 0 || i < first) {
+			first = i
+		}
+	}
+	start := first - snippetLength/3
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetLength
+	if end > len(text) {
+		end, start = len(text), len(text)-snippetLength
+	}
+	// avoid splitting words, and so multi-byte characters
+	for start > 0 && text[start-1] != ' ' {
+		start--
+	}
+	for end < len(text) && text[end] != ' ' {
+		end++
+	}
+	s := strings.TrimSpace(text[start:end])
+	if start > 0 {
+		s = "…" + s
+	}
+	if end < len(text) {
+		s += "…"
+	}
+	return s
+}
+
+// Link is the zoom recording of doc, starting at entry where zoom supports it, falling back to the archive folder
+func (doc *Document) Link(entry Entry) string {
+	if doc.ShareURL == "" {
+		return doc.FolderURL
+	}
+	if doc.RecordingStart.IsZero() {
+		return doc.ShareURL
+	}
+	sep := "?"
+	if strings.Contains(doc.ShareURL, "?") {
+		sep = "&"
+	}
+	// zoom's player starts at startTime, in milliseconds since the epoch
+	at := doc.RecordingStart.Add(entry.Offset)
+	return doc.ShareURL + sep + "startTime=" + strconv.FormatInt(at.UnixNano()/int64(time.Millisecond), 10)
+}
@@ -0,0 +1,111 @@
+package search
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testDocuments() []Document {
+	return []Document{
+		{
+			ID: "older", MeetingID: 123, Topic: "Team Weekly", Kind: "transcript",
+			Start:          time.Date(2020, 4, 1, 14, 0, 0, 0, time.UTC),
+			RecordingStart: time.Date(2020, 4, 1, 14, 1, 0, 0, time.UTC),
+			ShareURL:       "https://zoom.us/rec/share/abc",
+			Entries: []Entry{
+				{Offset: 5 * time.Second, Speaker: "Alice", Text: "Welcome everyone, let's review the release."},
+				{Offset: time.Minute, Speaker: "Bob", Text: "The release is blocked on the flaky tests."},
+			},
+		},
+		{
+			ID: "newer", MeetingID: 123, Topic: "Team Weekly", Kind: "chat",
+			Start:     time.Date(2020, 4, 8, 14, 0, 0, 0, time.UTC),
+			FolderURL: "https://drive.google.com/drive/folders/f",
+			Entries: []Entry{
+				{Offset: 90 * time.Second, Speaker: "Carol", Text: "Release notes: https://example.com/release"},
+			},
+		},
+	}
+}
+
+func TestSearch(t *testing.T) {
+	ix := New("")
+	for _, doc := range testDocuments() {
+		ix.Add(doc)
+	}
+	assert.Equal(t, 2, ix.Len())
+
+	results := ix.Search("RELEASE", 0)
+	require.Len(t, results, 3)
+	// release appears twice in carol's message
+	assert.Equal(t, "newer", results[0].Document.ID)
+	assert.Equal(t, "older", results[1].Document.ID)
+
+	results = ix.Search("flaky release", 0)
+	require.Len(t, results, 1)
+	assert.Equal(t, "Bob", results[0].Entry.Speaker)
+	assert.Equal(t, "https://zoom.us/rec/share/abc?startTime=1585749720000", results[0].Document.Link(results[0].Entry))
+
+	// speakers are searchable too
+	results = ix.Search("carol", 0)
+	require.Len(t, results, 1)
+	// without a zoom recording to link to, results link to the archive
+	assert.Equal(t, "https://drive.google.com/drive/folders/f", results[0].Document.Link(results[0].Entry))
+	assert.Empty(t, ix.Search("release missing", 0))
+	assert.Empty(t, ix.Search("  ", 0))
+	assert.Len(t, ix.Search("release", 1), 1)
+
+	// replacing a document drops its old entries
+	doc := testDocuments()[0]
+	doc.Entries = doc.Entries[:1]
+	ix.Add(doc)
+	assert.Empty(t, ix.Search("flaky", 0))
+	assert.Len(t, ix.Search("welcome", 0), 1)
+}
+
+func TestSnippet(t *testing.T) {
+	text := strings.Repeat("lorem ipsum ", 30) + "needle " + strings.Repeat("dolor sit ", 30)
+	s := snippet(text, []string{"needle"})
+	assert.Contains(t, s, "needle")
+	assert.True(t, strings.HasPrefix(s, "…lorem") || strings.HasPrefix(s, "…ipsum"), s)
+	assert.True(t, strings.HasSuffix(s, "…"), s)
+	assert.True(t, len(s) < len(text)/2)
+	assert.Equal(t, "short", snippet("short", []string{"short"}))
+}
+
+func TestPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index.json")
+
+	ix, err := Open(path)
+	require.NoError(t, err)
+	assert.Equal(t, 0, ix.Len())
+	for _, doc := range testDocuments() {
+		ix.Add(doc)
+	}
+	require.NoError(t, ix.Save())
+
+	other, err := Open(path)
+	require.NoError(t, err)
+	assert.True(t, other.Has("older"))
+	assert.Len(t, other.Search("flaky", 0), 1)
+
+	// changes saved by another process are picked up
+	doc := testDocuments()[1]
+	doc.ID = "another"
+	other.Add(doc)
+	require.NoError(t, other.Save())
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, future, future))
+	require.NoError(t, ix.Refresh())
+	assert.True(t, ix.Has("another"))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.elastic.co/apm"
+	"google.golang.org/api/drive/v3"
+
+	"github.com/graphaelli/zat/google"
+	"github.com/graphaelli/zat/zoom"
+)
+
+const (
+	shareTypeUser         = "user"
+	shareTypeGroup        = "group"
+	shareTypeDomain       = "domain"
+	shareTypeAnyone       = "anyone"
+	shareTypeRegistrants  = "registrants"
+	shareTypeParticipants = "participants"
+)
+
+// ShareRule grants access to a meeting folder when zat creates it.
+type ShareRule struct {
+	// Type is one of user, group, domain, anyone, registrants or participants.
+	// registrants and participants are expanded to a user grant per zoom attendee with an email address.
+	Type string `json:"type"`
+	// Role is the drive role to grant, reader unless specified.
+	Role string `json:"role,omitempty"`
+	// Email is the user or group address, required for those types.
+	Email string `json:"email,omitempty"`
+	// Domain is required for the domain type.
+	Domain string `json:"domain,omitempty"`
+	// Discoverable allows domain and anyone grants to be found via search rather than only by link.
+	Discoverable bool `json:"discoverable,omitempty"`
+}
+
+func (r ShareRule) validate() error {
+	switch r.Type {
+	case shareTypeUser, shareTypeGroup:
+		if r.Email == "" {
+			return fmt.Errorf("%s share requires an email", r.Type)
+		}
+	case shareTypeDomain:
+		if r.Domain == "" {
+			return fmt.Errorf("%s share requires a domain", r.Type)
+		}
+	case shareTypeAnyone, shareTypeRegistrants, shareTypeParticipants:
+	default:
+		return fmt.Errorf("unknown share type %q", r.Type)
+	}
+	switch r.role() {
+	case "reader", "commenter", "writer", "fileOrganizer", "organizer":
+	default:
+		return fmt.Errorf("unknown share role %q", r.Role)
+	}
+	return nil
+}
+
+func (r ShareRule) role() string {
+	if r.Role == "" {
+		return "reader"
+	}
+	return r.Role
+}
+
+// permissions expands a rule into drive permissions, looking up attendee addresses as needed.
+func (r ShareRule) permissions(attendees func(string) ([]string, error)) ([]*drive.Permission, error) {
+	switch r.Type {
+	case shareTypeUser, shareTypeGroup:
+		return []*drive.Permission{{Type: r.Type, Role: r.role(), EmailAddress: r.Email}}, nil
+	case shareTypeDomain:
+		return []*drive.Permission{{Type: r.Type, Role: r.role(), Domain: r.Domain, AllowFileDiscovery: r.Discoverable}}, nil
+	case shareTypeAnyone:
+		return []*drive.Permission{{Type: r.Type, Role: r.role(), AllowFileDiscovery: r.Discoverable}}, nil
+	}
+	emails, err := attendees(r.Type)
+	if err != nil {
+		return nil, err
+	}
+	perms := make([]*drive.Permission, len(emails))
+	for i, email := range emails {
+		perms[i] = &drive.Permission{Type: shareTypeUser, Role: r.role(), EmailAddress: email}
+	}
+	return perms, nil
+}
+
+// meetingAttendees returns the unique email addresses of a meeting's registrants or participants.
+func (z *Config) meetingAttendees(ctx context.Context, meeting zoom.Meeting, kind string) ([]string, error) {
+	seen := map[string]bool{}
+	var emails []string
+	add := func(email string) {
+		email = strings.ToLower(strings.TrimSpace(email))
+		if email != "" && !seen[email] {
+			seen[email] = true
+			emails = append(emails, email)
+		}
+	}
+	nextPageToken := ""
+	for {
+		switch kind {
+		case shareTypeRegistrants:
+			rsp, err := z.zoomClient.ListMeetingRegistrants(ctx, meeting.ID, nextPageToken)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range rsp.Registrants {
+				add(r.Email)
+			}
+			nextPageToken = rsp.NextPageToken
+		case shareTypeParticipants:
+			rsp, err := z.zoomClient.ListPastMeetingParticipants(ctx, meeting.UUID, nextPageToken)
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range rsp.Participants {
+				add(p.UserEmail)
+			}
+			nextPageToken = rsp.NextPageToken
+		default:
+			return nil, fmt.Errorf("unknown attendee kind %q", kind)
+		}
+		if nextPageToken == "" {
+			return emails, nil
+		}
+	}
+}
+
+// shareFolder applies the directive's share rules to a newly created meeting folder.
+// All rules are attempted, the first error encountered is returned.
+func (z *Config) shareFolder(ctx context.Context, gdrive *google.Drive, folder *drive.File, meeting zoom.Meeting, rules []ShareRule) error {
+	span, ctx := apm.StartSpan(ctx, "shareFolder", "app")
+	defer span.End()
+
+	attendees := func(kind string) ([]string, error) {
+		return z.meetingAttendees(ctx, meeting, kind)
+	}
+	var firstErr error
+	for _, rule := range rules {
+		perms, err := rule.permissions(attendees)
+		if err != nil {
+			err = fmt.Errorf("while finding %s to share %s with: %w", rule.Type, folder.Name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, perm := range perms {
+			if err := gdrive.CreatePermission(ctx, folder.Id, perm, false); err != nil {
+				err = fmt.Errorf("while granting %s %s to %s: %w", perm.Role, perm.Type, folder.Name, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			z.logger.Printf("granted %s %s%s%s to %s", perm.Role, perm.Type, prefixed(" ", perm.EmailAddress),
+				prefixed(" ", perm.Domain), folder.Name)
+		}
+	}
+	return firstErr
+}
+
+func prefixed(prefix, s string) string {
+	if s == "" {
+		return ""
+	}
+	return prefix + s
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.elastic.co/apm"
+	"google.golang.org/api/drive/v3"
+
+	"github.com/graphaelli/zat/google"
+	"github.com/graphaelli/zat/zoom"
+)
+
+const (
+	// transcodeVideo, transcodeAudio and transcodeThumbnail tag the files made from mp4 recordings
+	transcodeVideo     = "transcoded.mp4"
+	transcodeAudio     = "audio.m4a"
+	transcodeThumbnail = "thumbnail.jpg"
+
+	// originalKeep archives re-encoded video alongside the original, originalReplace instead of it
+	originalKeep    = "keep"
+	originalReplace = "replace"
+
+	// transcodeTimeout is how long ffmpeg may take over a recording
+	transcodeTimeout = 4 * time.Hour
+	// thumbnailHeight is the most lines in a thumbnail
+	thumbnailHeight = 360
+)
+
+// bitrate matches ffmpeg bitrates, eg 500k
+var bitrate = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[kKM]?$`)
+
+// Transcode configures what ffmpeg makes of mp4 recordings before they are archived
+type Transcode struct {
+	// Height scales video down to at most this many lines, eg 720
+	Height int `json:"height,omitempty"`
+	// VideoBitrate and AudioBitrate are ffmpeg bitrates, eg 500k and 64k
+	VideoBitrate string `json:"video_bitrate,omitempty" yaml:"video_bitrate"`
+	AudioBitrate string `json:"audio_bitrate,omitempty" yaml:"audio_bitrate"`
+	// Audio extracts an m4a from mp4 recordings when zoom recorded no audio file
+	Audio bool `json:"audio,omitempty"`
+	// Thumbnail keeps a jpg frame of each mp4 recording
+	Thumbnail bool `json:"thumbnail,omitempty"`
+	// Original is what becomes of the original once re-encoded, keep or replace, keep when unset
+	Original string `json:"original,omitempty"`
+}
+
+func (t *Transcode) validate() error {
+	if t.Height < 0 {
+		return errors.New("height must not be negative")
+	}
+	for _, rate := range []string{t.VideoBitrate, t.AudioBitrate} {
+		if rate != "" && !bitrate.MatchString(rate) {
+			return fmt.Errorf("invalid bitrate %q", rate)
+		}
+	}
+	switch t.Original {
+	case "", originalKeep:
+	case originalReplace:
+		if !t.video() {
+			return errors.New("replacing the original requires height or video_bitrate")
+		}
+	default:
+		return fmt.Errorf("invalid original %q, must be %s or %s", t.Original, originalKeep, originalReplace)
+	}
+	if !t.video() && !t.Audio && !t.Thumbnail {
+		return errors.New("nothing to transcode, set height, video_bitrate, audio or thumbnail")
+	}
+	return nil
+}
+
+// video reports whether recordings are re-encoded
+func (t *Transcode) video() bool {
+	return t.Height > 0 || t.VideoBitrate != ""
+}
+
+func (t *Transcode) replaces() bool {
+	return t.Original == originalReplace
+}
+
+// transcodes reports whether t applies to f
+func (t *Transcode) transcodes(f zoom.RecordingFile) bool {
+	return t != nil && isPreferred(f)
+}
+
+// formats lists the files made from each mp4 recording of meeting, other than a replaced original
+func (t *Transcode) formats(meeting zoom.Meeting) []string {
+	var formats []string
+	if t.video() && !t.replaces() {
+		formats = append(formats, transcodeVideo)
+	}
+	if t.Audio && !hasAudio(meeting) {
+		formats = append(formats, transcodeAudio)
+	}
+	if t.Thumbnail {
+		formats = append(formats, transcodeThumbnail)
+	}
+	return formats
+}
+
+// hasAudio reports whether zoom recorded an audio file for meeting
+func hasAudio(meeting zoom.Meeting) bool {
+	for _, f := range meeting.RecordingFiles {
+		if strings.ToLower(f.FileType) == "m4a" {
+			return true
+		}
+	}
+	return false
+}
+
+// transcodedFileName constructs the name of a file made from the archived mp4 name
+func transcodedFileName(name, format string) string {
+	base := strings.TrimSuffix(name, path.Ext(name))
+	switch format {
+	case transcodeAudio:
+		return base + ".m4a"
+	case transcodeThumbnail:
+		return base + ".jpg"
+	default:
+		return base + ".transcoded.mp4"
+	}
+}
+
+// transcodedProperties tags a file made from recording f. Extracted audio is tagged as audio so podcasts find it.
+func transcodedProperties(meeting zoom.Meeting, f zoom.RecordingFile, format string) map[string]string {
+	props := fileProperties(meeting, f, format)
+	if format == transcodeAudio {
+		props[propFileType] = "m4a"
+	}
+	return props
+}
+
+// thumbnailOffset is when in recording f its thumbnail is taken, past any blank opening frames.
+// For a trimmed recording it is within the part kept by cut, which the trimmed file starts at.
+func thumbnailOffset(f zoom.RecordingFile, cut trimCut) time.Duration {
+	var length time.Duration
+	start, serr := time.Parse(time.RFC3339, f.RecordingStart)
+	end, eerr := time.Parse(time.RFC3339, f.RecordingEnd)
+	if serr == nil && eerr == nil && end.After(start) {
+		length = end.Sub(start)
+	}
+	if cut.End > 0 && (length == 0 || cut.End < length) {
+		length = cut.End
+	}
+	if length <= cut.Start {
+		return 0
+	}
+	return (length - cut.Start) / 10
+}
+
+// ffmpegArgs are the arguments for ffmpeg to make format from the recording at in, trimmed to cut, writing it to out
+func (t *Transcode) ffmpegArgs(format string, f zoom.RecordingFile, cut trimCut, in, out string) []string {
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin", "-y"}
+	switch format {
+	case transcodeAudio:
+		args = append(args, "-i", in, "-vn")
+		if t.AudioBitrate != "" {
+			args = append(args, "-c:a", "aac", "-b:a", t.AudioBitrate)
+		} else {
+			args = append(args, "-c:a", "copy")
+		}
+	case transcodeThumbnail:
+		offset := strconv.FormatFloat(thumbnailOffset(f, cut).Seconds(), 'f', 3, 64)
+		args = append(args, "-ss", offset, "-i", in, "-frames:v", "1", "-q:v", "3",
+			"-vf", fmt.Sprintf("scale=-2:'min(%d,ih)'", thumbnailHeight))
+	default:
+		args = append(args, "-i", in, "-c:v", "libx264")
+		if t.Height > 0 {
+			args = append(args, "-vf", fmt.Sprintf("scale=-2:'min(%d,ih)'", t.Height))
+		}
+		if t.VideoBitrate != "" {
+			args = append(args, "-b:v", t.VideoBitrate)
+		}
+		args = append(args, "-c:a", "aac")
+		if t.AudioBitrate != "" {
+			args = append(args, "-b:a", t.AudioBitrate)
+		}
+		// so playback can start before the whole file is downloaded
+		args = append(args, "-movflags", "+faststart")
+	}
+	return append(args, out)
+}
+
+// ffmpegPath is the ffmpeg binary to run
+func (z *Config) ffmpegPath() string {
+	if z.ffmpeg != "" {
+		return z.ffmpeg
+	}
+	return "ffmpeg"
+}
+
+// transcode runs ffmpeg to make format from the recording at in, trimmed to cut, returning the path of the file made in dir
+func (z *Config) transcode(ctx context.Context, t *Transcode, f zoom.RecordingFile, cut trimCut, in, dir, format string) (string, error) {
+	span, ctx := apm.StartSpan(ctx, "transcode "+format, "app")
+	defer span.End()
+
+	out := filepath.Join(dir, transcodedFileName("recording.mp4", format))
+	if err := z.runCommand(ctx, transcodeTimeout, append([]string{z.ffmpegPath()}, t.ffmpegArgs(format, f, cut, in, out)...), nil); err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(out); err != nil {
+		return "", err
+	} else if info.Size() == 0 {
+		return "", errors.New("ffmpeg wrote nothing")
+	}
+	return out, nil
+}
+
+// uploadFile uploads the file at path to a new drive file tagged with its checksum.
+// The file is hashed first, so the upload can be rewound and retried.
+func uploadFile(ctx context.Context, gdrive *google.Drive, file *drive.File, path string) error {
+	r, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if file.AppProperties == nil {
+		file.AppProperties = make(map[string]string)
+	}
+	file.AppProperties[propChecksum] = hex.EncodeToString(h.Sum(nil))
+	_, err = gdrive.CreateFile(ctx, file, r)
+	return err
+}
+
+// archiveTranscoded archives the mp4 recording f, uploading the original unless replaced, and the files
+// in formats made from it. The recording is spooled to disk for ffmpeg, unless a hook already did.
+func (z *Config) archiveTranscoded(ctx context.Context, gdrive *google.Drive, folder *drive.File, meeting zoom.Meeting,
+	f zoom.RecordingFile, name string, body io.Reader, uploadOriginal bool, formats []string, action Directive) error {
+	span, ctx := apm.StartSpan(ctx, "archiveTranscoded", "app")
+	defer span.End()
+
+	t := action.Transcode
+	cut := trimmedCut(folder, action, f)
+	var in string
+	if spooled, ok := body.(spooledFile); ok {
+		in = spooled.Name()
+	} else {
+		var err error
+		if in, err = spool(body, name); err != nil {
+			return fmt.Errorf("while downloading recording %s: %w", name, err)
+		}
+		defer os.Remove(in)
+	}
+	dir, err := ioutil.TempDir("", "zat-transcode")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if uploadOriginal {
+		original := in
+		if t.replaces() {
+			transcoded, err := z.transcode(ctx, t, f, cut, in, dir, transcodeVideo)
+			if err != nil {
+				return fmt.Errorf("while transcoding recording %s: %w", name, err)
+			}
+			if smaller(transcoded, in) {
+				original = transcoded
+			} else {
+				z.logger.Printf("archiving original %q, transcoding didn't make it smaller", name)
+			}
+		}
+		if err := uploadFile(ctx, gdrive, &drive.File{
+			Name:                         name,
+			Parents:                      []string{folder.Id},
+			CopyRequiresWriterPermission: action.CopyRequiresWriterPermission,
+			AppProperties:                fileProperties(meeting, f, ""),
+		}, original); err != nil {
+			return fmt.Errorf("while uploading recording %s: %w", name, err)
+		}
+		z.logger.Printf("uploaded %q to %s", name, folder.Name)
+	}
+
+	for _, format := range formats {
+		out, err := z.transcode(ctx, t, f, cut, in, dir, format)
+		if err != nil {
+			return fmt.Errorf("while transcoding %s of recording %s: %w", format, name, err)
+		}
+		file := &drive.File{
+			Name:                         transcodedFileName(name, format),
+			Parents:                      []string{folder.Id},
+			CopyRequiresWriterPermission: action.CopyRequiresWriterPermission,
+			AppProperties:                transcodedProperties(meeting, f, format),
+		}
+		if err := uploadFile(ctx, gdrive, file, out); err != nil {
+			return fmt.Errorf("while uploading %s: %w", file.Name, err)
+		}
+		z.logger.Printf("uploaded %q to %s", file.Name, folder.Name)
+	}
+	return nil
+}
+
+// smaller reports whether the file at a is smaller than the file at b
+func smaller(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return ai.Size() < bi.Size()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"go.elastic.co/apm"
+	"google.golang.org/api/drive/v3"
+
+	"github.com/graphaelli/zat/google"
+	"github.com/graphaelli/zat/zoom"
+	"github.com/graphaelli/zat/zoom/vtt"
+)
+
+const (
+	transcriptDoc      = "doc"
+	transcriptText     = "txt"
+	transcriptMarkdown = "md"
+)
+
+// isTranscript reports whether f is a vtt file - an audio transcript or closed captions
+func isTranscript(f zoom.RecordingFile) bool {
+	fileType := strings.ToLower(f.FileType)
+	return fileType == "transcript" || fileType == "cc"
+}
+
+// transcriptFileName constructs the name of a converted transcript from the archived vtt name
+func transcriptFileName(name, format string) string {
+	base := strings.TrimSuffix(name, path.Ext(name))
+	if format == transcriptDoc {
+		// google docs don't have an extension
+		return base
+	}
+	return base + "." + format
+}
+
+// convertTranscript renders transcript paragraphs in format, returning the drive file to create with it.
+func convertTranscript(format, title string, paragraphs []vtt.Paragraph) (*drive.File, []byte, string, error) {
+	var buf bytes.Buffer
+	file := &drive.File{}
+	var contentType string
+	var err error
+	switch format {
+	case transcriptDoc:
+		// drive converts html uploads to a google doc
+		file.MimeType = google.MimeTypeDocument
+		contentType = "text/html"
+		err = vtt.RenderHTML(&buf, title, paragraphs)
+	case transcriptText:
+		contentType = "text/plain"
+		err = vtt.RenderText(&buf, paragraphs)
+	case transcriptMarkdown:
+		contentType = "text/markdown"
+		err = vtt.RenderMarkdown(&buf, title, paragraphs)
+	default:
+		err = fmt.Errorf("unknown transcript format %q", format)
+	}
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return file, buf.Bytes(), contentType, nil
+}
+
+// archiveTranscript uploads a vtt transcript, unless it has already been archived, along with the requested conversions.
+func (z *Config) archiveTranscript(ctx context.Context, gdrive *google.Drive, folder *drive.File, meeting zoom.Meeting,
+	f zoom.RecordingFile, name string, body io.Reader, uploadOriginal bool, formats []string, action Directive) error {
+	span, ctx := apm.StartSpan(ctx, "archiveTranscript", "app")
+	defer span.End()
+
+	original, err := ioutil.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("while downloading transcript %s: %w", name, err)
+	}
+	if uploadOriginal {
+		if _, err := uploadBytes(ctx, gdrive, &drive.File{
+			Name:                         name,
+			Parents:                      []string{folder.Id},
+			CopyRequiresWriterPermission: action.CopyRequiresWriterPermission,
+			AppProperties:                fileProperties(meeting, f, ""),
+		}, original, ""); err != nil {
+			return fmt.Errorf("while uploading transcript %s: %w", name, err)
+		}
+		z.logger.Printf("uploaded %q to %s", name, folder.Name)
+	}
+
+	// conversions are supplementary, the original is archived even when they fail, they are retried on later runs
+	cues, err := vtt.Parse(bytes.NewReader(original))
+	if err != nil {
+		z.logger.Printf("failed to parse transcript %s: %s", name, err)
+		apm.CaptureError(ctx, err).Send()
+		return nil
+	}
+	paragraphs := vtt.Paragraphs(cues)
+	title := fmt.Sprintf("%s %s", meeting.Topic, meeting.StartTime.Format("2006-01-02 15:04"))
+	for _, format := range formats {
+		file, converted, contentType, err := convertTranscript(format, title, paragraphs)
+		if err != nil {
+			z.logger.Printf("failed to convert transcript %s to %s: %s", name, format, err)
+			apm.CaptureError(ctx, err).Send()
+			continue
+		}
+		file.Name = transcriptFileName(name, format)
+		file.Parents = []string{folder.Id}
+		file.CopyRequiresWriterPermission = action.CopyRequiresWriterPermission
+		file.AppProperties = fileProperties(meeting, f, format)
+		if _, err := uploadBytes(ctx, gdrive, file, converted, contentType); err != nil {
+			z.logger.Printf("failed to upload transcript %s: %s", file.Name, err)
+			apm.CaptureError(ctx, err).Send()
+			continue
+		}
+		z.logger.Printf("uploaded %q to %s", file.Name, folder.Name)
+	}
+	return nil
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.elastic.co/apm"
+	"google.golang.org/api/drive/v3"
+
+	"github.com/graphaelli/zat/google"
+	"github.com/graphaelli/zat/zoom"
+	"github.com/graphaelli/zat/zoom/vtt"
+)
+
+const (
+	// detectSilence and detectFreeze find dead air by ffmpeg's silencedetect and freezedetect filters
+	detectSilence = "silence"
+	detectFreeze  = "freeze"
+
+	// trimMinDuration is the shortest dead air trimmed by default
+	trimMinDuration = 30 * time.Second
+	// trimNoise is the level audio is silent below by default
+	trimNoise = "-50dB"
+	// trimMargin is left around what is kept, so the first and last words aren't clipped
+	trimMargin = time.Second
+	// propTrim tags meeting folders with what was trimmed from each recording, by recording start
+	propTrim = "zatTrim"
+)
+
+// noise matches ffmpeg noise levels in decibels
+var noise = regexp.MustCompile(`^-[0-9]+(\.[0-9]+)?dB$`)
+
+// Trim configures trimming dead air from the start and end of recordings, typically waiting for people to join
+type Trim struct {
+	// Detect lists what is dead air, silence and/or a frozen picture, both when unset.
+	// Dead air has to be all of them, a frozen picture is only detected in mp4 recordings.
+	Detect []string `json:"detect,omitempty"`
+	// MinDuration is the shortest dead air trimmed, trimMinDuration when unset
+	MinDuration time.Duration `json:"min_duration,omitempty" yaml:"min_duration"`
+	// Noise is the level audio is silent below, trimNoise when unset
+	Noise string `json:"noise,omitempty"`
+}
+
+func (t *Trim) validate() error {
+	for _, d := range t.Detect {
+		if d != detectSilence && d != detectFreeze {
+			return fmt.Errorf("invalid detect %q, must be %s or %s", d, detectSilence, detectFreeze)
+		}
+	}
+	if t.MinDuration < 0 {
+		return errors.New("min_duration must not be negative")
+	}
+	if t.Noise != "" && !noise.MatchString(t.Noise) {
+		return fmt.Errorf("invalid noise %q, must be negative decibels, eg %s", t.Noise, trimNoise)
+	}
+	return nil
+}
+
+func (t *Trim) detects(d string) bool {
+	return len(t.Detect) == 0 || containsFold(t.Detect, d)
+}
+
+func (t *Trim) minDuration() time.Duration {
+	if t.MinDuration > 0 {
+		return t.MinDuration
+	}
+	return trimMinDuration
+}
+
+func (t *Trim) noise() string {
+	if t.Noise != "" {
+		return t.Noise
+	}
+	return trimNoise
+}
+
+// isAudio reports whether f is zoom's audio only recording
+func isAudio(f zoom.RecordingFile) bool {
+	return strings.ToLower(f.FileType) == "m4a"
+}
+
+// trims reports whether t applies to f
+func (t *Trim) trims(f zoom.RecordingFile) bool {
+	return t != nil && (isPreferred(f) || isAudio(f) || isTranscript(f))
+}
+
+// trimOrder orders files so dead air is detected in video before audio, and both before transcripts are trimmed to match
+func trimOrder(files []zoom.RecordingFile) []zoom.RecordingFile {
+	rank := func(f zoom.RecordingFile) int {
+		switch {
+		case isPreferred(f):
+			return 0
+		case isAudio(f):
+			return 1
+		default:
+			return 2
+		}
+	}
+	ordered := append([]zoom.RecordingFile{}, files...)
+	sort.SliceStable(ordered, func(i, j int) bool { return rank(ordered[i]) < rank(ordered[j]) })
+	return ordered
+}
+
+// trimCut is the part of a recording kept, from Start until End, or the end of the recording when End is 0
+type trimCut struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+func (c trimCut) zero() bool {
+	return c.Start == 0 && c.End == 0
+}
+
+// String formats c as seconds, to tag meeting folders with
+func (c trimCut) String() string {
+	end := ""
+	if c.End > 0 {
+		end = formatSeconds(c.End)
+	}
+	return formatSeconds(c.Start) + "," + end
+}
+
+func parseTrimCut(s string) (trimCut, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return trimCut{}, fmt.Errorf("invalid trim %q", s)
+	}
+	var c trimCut
+	var err error
+	if c.Start, err = parseSeconds(parts[0]); err != nil {
+		return c, err
+	}
+	if parts[1] != "" {
+		c.End, err = parseSeconds(parts[1])
+	}
+	return c, err
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+func parseSeconds(s string) (time.Duration, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(f * float64(time.Second)), nil
+}
+
+// trimKey is the folder property recording what was trimmed from the recordings that started with f
+func trimKey(f zoom.RecordingFile) string {
+	return propTrim + f.RecordingStart
+}
+
+// interval is a span of a recording
+type interval struct {
+	start, end time.Duration
+}
+
+var (
+	ffmpegDuration = regexp.MustCompile(`Duration: (\d+):(\d+):(\d+(?:\.\d+)?)`)
+	ffmpegDetected = regexp.MustCompile(`(silence|freeze)_(start|end): (-?[0-9.]+)`)
+)
+
+// parseDetected reads the duration of the recording and the intervals filter detected from ffmpeg's output.
+// Intervals still open at the end of the recording end with it.
+func parseDetected(output, filter string) (time.Duration, []interval, error) {
+	m := ffmpegDuration.FindStringSubmatch(output)
+	if m == nil {
+		return 0, nil, errors.New("no duration in ffmpeg output")
+	}
+	h, _ := strconv.Atoi(m[1])
+	min, _ := strconv.Atoi(m[2])
+	sec, _ := parseSeconds(m[3])
+	duration := time.Duration(h)*time.Hour + time.Duration(min)*time.Minute + sec
+
+	var intervals []interval
+	open := false
+	for _, m := range ffmpegDetected.FindAllStringSubmatch(output, -1) {
+		if m[1] != filter {
+			continue
+		}
+		at, err := parseSeconds(m[3])
+		if err != nil {
+			return 0, nil, err
+		}
+		if at < 0 {
+			at = 0
+		}
+		switch {
+		case m[2] == "start":
+			intervals = append(intervals, interval{start: at, end: duration})
+			open = true
+		case open:
+			intervals[len(intervals)-1].end = at
+			open = false
+		}
+	}
+	return duration, intervals, nil
+}
+
+// intersect is where both a and b are, they are ordered and don't overlap
+func intersect(a, b []interval) []interval {
+	var both []interval
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		start, end := a[i].start, a[i].end
+		if b[j].start > start {
+			start = b[j].start
+		}
+		if b[j].end < end {
+			end = b[j].end
+		}
+		if start < end {
+			both = append(both, interval{start, end})
+		}
+		if a[i].end < b[j].end {
+			i++
+		} else {
+			j++
+		}
+	}
+	return both
+}
+
+// deadAirCut is the part of a recording of duration kept once dead air of at least min is trimmed from its start and end
+func deadAirCut(duration time.Duration, dead []interval, min time.Duration) trimCut {
+	var c trimCut
+	var long []interval
+	for _, d := range dead {
+		if d.end-d.start >= min {
+			long = append(long, d)
+		}
+	}
+	if len(long) == 0 {
+		return c
+	}
+	// ffmpeg reports dead air from the start at about 0, and to the end at about the duration
+	if first := long[0]; first.start <= trimMargin && first.end-trimMargin > 0 {
+		c.Start = first.end - trimMargin
+	}
+	if last := long[len(long)-1]; last.end >= duration-trimMargin && last.start+trimMargin < duration {
+		c.End = last.start + trimMargin
+	}
+	if c.End > 0 && c.End <= c.Start {
+		// nothing but dead air, keep it all rather than nothing
+		return trimCut{}
+	}
+	return c
+}
+
+// detectArgs are the arguments for ffmpeg to find the dead air in the recording at in
+func (t *Trim) detectArgs(in string, video bool) []string {
+	d := formatSeconds(t.minDuration())
+	args := []string{"-hide_banner", "-nostats", "-nostdin", "-i", in}
+	if t.detects(detectSilence) {
+		args = append(args, "-af", fmt.Sprintf("silencedetect=noise=%s:d=%s", t.noise(), d))
+	} else {
+		args = append(args, "-an")
+	}
+	if video && t.detects(detectFreeze) {
+		args = append(args, "-vf", "freezedetect=d="+d)
+	} else {
+		args = append(args, "-vn")
+	}
+	return append(args, "-f", "null", "-")
+}
+
+// detectDeadAir runs ffmpeg over the recording f at in, returning the part to keep
+func (z *Config) detectDeadAir(ctx context.Context, t *Trim, f zoom.RecordingFile, in string) (trimCut, error) {
+	span, ctx := apm.StartSpan(ctx, "detectDeadAir", "app")
+	defer span.End()
+
+	video := isPreferred(f)
+	command := append([]string{z.ffmpegPath()}, t.detectArgs(in, video)...)
+	out, err := commandOutput(ctx, transcodeTimeout, command, nil)
+	if err != nil {
+		z.logOutput(command, out)
+		return trimCut{}, err
+	}
+	var dead []interval
+	var duration time.Duration
+	first := true
+	for _, filter := range []string{detectSilence, detectFreeze} {
+		if !t.detects(filter) || (filter == detectFreeze && !video) {
+			continue
+		}
+		var detected []interval
+		if duration, detected, err = parseDetected(string(out), filter); err != nil {
+			return trimCut{}, err
+		}
+		if first {
+			dead, first = detected, false
+		} else {
+			dead = intersect(dead, detected)
+		}
+	}
+	if first {
+		// only freezes are detected, and this is audio
+		return trimCut{}, nil
+	}
+	return deadAirCut(duration, dead, t.minDuration()), nil
+}
+
+// keyframeArgs are the arguments for ffprobe to list the video keyframes of the recording at in from the one before at
+func keyframeArgs(in string, at time.Duration) []string {
+	return []string{"-v", "error", "-select_streams", "v:0", "-skip_frame", "nokey", "-show_entries", "frame=pts_time",
+		"-of", "csv=p=0", "-read_intervals", formatSeconds(at) + "%+10", in}
+}
+
+// parseKeyframe finds the last keyframe at or before at in ffprobe's output, rounded up to the millisecond
+// so that ffmpeg seeking to it doesn't land on the keyframe before
+func parseKeyframe(output string, at time.Duration) (time.Duration, error) {
+	found := false
+	var keyframe time.Duration
+	for _, line := range strings.Fields(output) {
+		pts, err := parseSeconds(strings.TrimSuffix(line, ","))
+		if err != nil {
+			// eg N/A
+			continue
+		}
+		pts = (pts + time.Millisecond - 1).Truncate(time.Millisecond)
+		if pts <= at && (!found || pts > keyframe) {
+			keyframe, found = pts, true
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("no keyframe before %s", formatSeconds(at))
+	}
+	return keyframe, nil
+}
+
+// ffprobePath is the ffprobe binary to run, alongside ffmpeg
+func (z *Config) ffprobePath() string {
+	ffmpeg := z.ffmpegPath()
+	dir, base := filepath.Split(ffmpeg)
+	return filepath.Join(dir, strings.Replace(base, "ffmpeg", "ffprobe", 1))
+}
+
+// keyframeBefore is the start of the video keyframe at or before at in the recording at in.
+// Cutting without re-encoding starts at a keyframe, transcripts are shifted by it to line up.
+func (z *Config) keyframeBefore(ctx context.Context, in string, at time.Duration) (time.Duration, error) {
+	command := append([]string{z.ffprobePath()}, keyframeArgs(in, at)...)
+	out, err := commandOutput(ctx, transcodeTimeout, command, nil)
+	if err != nil {
+		z.logOutput(command, out)
+		return 0, err
+	}
+	return parseKeyframe(string(out), at)
+}
+
+// trimmedCut is what trimRecording kept of recording f, zero when it isn't trimmed
+func trimmedCut(folder *drive.File, action Directive, f zoom.RecordingFile) trimCut {
+	v, ok := folder.AppProperties[trimKey(f)]
+	if !ok || !action.Trim.trims(f) {
+		return trimCut{}
+	}
+	c, err := parseTrimCut(v)
+	if err != nil {
+		return trimCut{}
+	}
+	return c
+}
+
+// trimArgs are the arguments for ffmpeg to cut the recording at in to out, without re-encoding
+func trimArgs(c trimCut, in, out string) []string {
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin", "-y", "-ss", formatSeconds(c.Start), "-i", in}
+	if c.End > 0 {
+		args = append(args, "-t", formatSeconds(c.End-c.Start))
+	}
+	return append(args, "-c", "copy", "-movflags", "+faststart", out)
+}
+
+// recordingCut is what is kept of the recordings that started with f, as detected when the first was archived
+func (z *Config) recordingCut(ctx context.Context, gdrive *google.Drive, folder *drive.File, t *Trim,
+	f zoom.RecordingFile, in string) (trimCut, bool, error) {
+	if v, ok := folder.AppProperties[trimKey(f)]; ok {
+		c, err := parseTrimCut(v)
+		return c, true, err
+	}
+	if isTranscript(f) {
+		// transcripts are trimmed to match the recordings, which weren't trimmed
+		return trimCut{}, false, nil
+	}
+	c, err := z.detectDeadAir(ctx, t, f, in)
+	if err != nil {
+		return c, false, fmt.Errorf("while detecting dead air: %w", err)
+	}
+	if isPreferred(f) && c.Start > 0 {
+		if c.Start, err = z.keyframeBefore(ctx, in, c.Start); err != nil {
+			return c, false, fmt.Errorf("while finding keyframe: %w", err)
+		}
+	}
+	// recorded on the folder so the other recordings and transcript of the segment are trimmed the same, even on later runs
+	props := map[string]string{trimKey(f): c.String()}
+	if _, err := gdrive.UpdateFile(ctx, folder.Id, &drive.File{AppProperties: props}); err != nil {
+		return c, false, fmt.Errorf("while recording trim: %w", err)
+	}
+	if folder.AppProperties == nil {
+		folder.AppProperties = make(map[string]string)
+	}
+	folder.AppProperties[trimKey(f)] = c.String()
+	return c, true, nil
+}
+
+// trimRecording trims dead air from the start and end of the recording or transcript f downloaded as body,
+// returning what to archive instead
+func (z *Config) trimRecording(ctx context.Context, gdrive *google.Drive, folder *drive.File, action Directive,
+	f zoom.RecordingFile, name string, body io.Reader) (io.ReadCloser, error) {
+	span, ctx := apm.StartSpan(ctx, "trimRecording", "app")
+	defer span.End()
+
+	if isTranscript(f) {
+		c, _, err := z.recordingCut(ctx, gdrive, folder, action.Trim, f, "")
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, fmt.Errorf("while downloading transcript: %w", err)
+		}
+		if c.zero() {
+			return ioutil.NopCloser(bytes.NewReader(content)), nil
+		}
+		cues, err := vtt.Parse(bytes.NewReader(content))
+		if err != nil {
+			// trimming is best effort, the transcript is archived as downloaded
+			z.logger.Printf("failed to parse transcript %s: %s", name, err)
+			apm.CaptureError(ctx, err).Send()
+			return ioutil.NopCloser(bytes.NewReader(content)), nil
+		}
+		var buf bytes.Buffer
+		if err := vtt.Write(&buf, vtt.Trim(cues, c.Start, c.End)); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(&buf), nil
+	}
+
+	// trimming takes over the spooled download, closing a hook's spooled file again is harmless
+	in, ok := body.(spooledFile)
+	if !ok {
+		path, err := spool(body, name)
+		if err != nil {
+			return nil, fmt.Errorf("while spooling download: %w", err)
+		}
+		if in.File, err = os.Open(path); err != nil {
+			os.Remove(path)
+			return nil, err
+		}
+	}
+	c, _, err := z.recordingCut(ctx, gdrive, folder, action.Trim, f, in.Name())
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	if c.zero() {
+		return in, nil
+	}
+	defer in.Close()
+
+	out, err := spool(bytes.NewReader(nil), name)
+	if err != nil {
+		return nil, err
+	}
+	command := append([]string{z.ffmpegPath()}, trimArgs(c, in.Name(), out)...)
+	if err := z.runCommand(ctx, transcodeTimeout, command, nil); err != nil {
+		os.Remove(out)
+		return nil, fmt.Errorf("while trimming: %w", err)
+	}
+	trimmed, err := os.Open(out)
+	if err != nil {
+		os.Remove(out)
+		return nil, err
+	}
+	z.logger.Printf("trimmed %q to %s - %s", name, vtt.FormatOffset(c.Start), endOffset(c))
+	return spooledFile{trimmed}, nil
+}
+
+func endOffset(c trimCut) string {
+	if c.End == 0 {
+		return "end"
+	}
+	return vtt.FormatOffset(c.End)
+}
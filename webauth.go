@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"gopkg.in/yaml.v2"
+
+	"github.com/graphaelli/zat/google"
+	"github.com/graphaelli/zat/oauth"
+)
+
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+
+	sessionCookie = "zat_session"
+	sessionTTL    = 12 * time.Hour
+
+	googleUserInfoURL    = "https://openidconnect.googleapis.com/v1/userinfo"
+	googleGroupsScope    = "https://www.googleapis.com/auth/cloud-identity.groups.readonly"
+	cloudIdentityBaseURL = "https://cloudidentity.googleapis.com/v1/"
+)
+
+var roleLevels = map[string]int{
+	roleViewer:   1,
+	roleOperator: 2,
+}
+
+// webRoutes are the paths NewMux serves, which the sign in callback must not take over.
+// Paths ending in / serve everything below them.
+var webRoutes = []string{"/", "/archive", "/google", "/zoom", "/podcast/", "/search", "/oauth/google", "/oauth/zoom",
+	"/auth/login", "/auth/logout"}
+
+// callbackPath validates the path of the sign in redirect url, which is served alongside webRoutes
+func callbackPath(redirectURL string) (string, error) {
+	u, err := url.Parse(redirectURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid redirect_url %q: %w", redirectURL, err)
+	}
+	if !strings.HasPrefix(u.Path, "/") || u.Path == "/" {
+		return "", fmt.Errorf("redirect_url %q needs a path, eg /auth/callback", redirectURL)
+	}
+	for _, route := range webRoutes {
+		if u.Path == route || (route != "/" && strings.HasSuffix(route, "/") && strings.HasPrefix(u.Path, route)) {
+			return "", fmt.Errorf("redirect_url path %s is already served by zat, use eg /auth/callback", u.Path)
+		}
+	}
+	return u.Path, nil
+}
+
+// webAuthConfig restricts access to the web interface, read from auth.yml
+type webAuthConfig struct {
+	// SessionKey signs session cookies, base64 encoded. Sessions don't survive restarts without one.
+	SessionKey string `yaml:"session_key"`
+
+	// Google enables sign in with Google
+	Google *struct {
+		// RedirectURL is the sign in callback, eg http://localhost:8080/auth/callback,
+		// which must be an authorized redirect URI of the google OAuth client
+		RedirectURL string `yaml:"redirect_url"`
+		// AllowedDomains, AllowedEmails and AllowedGroups list who may sign in
+		AllowedDomains []string `yaml:"allowed_domains"`
+		AllowedEmails  []string `yaml:"allowed_emails"`
+		AllowedGroups  []string `yaml:"allowed_groups"`
+		// Operators may archive and use the drive and zoom endpoints, everyone else signed in is a viewer
+		Operators []string `yaml:"operators"`
+	} `yaml:"google"`
+
+	// Tokens grant API access with an "Authorization: Bearer" header
+	Tokens []struct {
+		Name  string `yaml:"name"`
+		Token string `yaml:"token"`
+		Role  string `yaml:"role"`
+	} `yaml:"tokens"`
+}
+
+// webUser is an authenticated user of the web interface
+type webUser struct {
+	Email   string    `json:"email"`
+	Role    string    `json:"role"`
+	Expires time.Time `json:"expires"`
+}
+
+func (u *webUser) can(role string) bool {
+	return u != nil && roleLevels[u.Role] >= roleLevels[role]
+}
+
+type webUserKey struct{}
+
+func webUserFromContext(ctx context.Context) *webUser {
+	u, _ := ctx.Value(webUserKey{}).(*webUser)
+	return u
+}
+
+// webAuth authenticates and authorizes web interface requests.
+// A nil *webAuth allows everything, as zat has always done.
+type webAuth struct {
+	logger     *log.Logger
+	config     webAuthConfig
+	key        []byte
+	flow       *oauth.Flow
+	callback   string
+	httpClient *http.Client
+}
+
+// NewWebAuthFromFile loads web authentication configuration, returning nil if path does not exist.
+func NewWebAuthFromFile(logger *log.Logger, path string, googleClient *google.Client) (*webAuth, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewWebAuthFromReader(logger, f, googleClient)
+}
+
+func NewWebAuthFromReader(logger *log.Logger, r io.Reader, googleClient *google.Client) (*webAuth, error) {
+	var config webAuthConfig
+	if err := yaml.NewDecoder(r).Decode(&config); err != nil && err != io.EOF {
+		return nil, err
+	}
+	a := &webAuth{
+		logger:     logger,
+		config:     config,
+		httpClient: http.DefaultClient,
+	}
+	if config.SessionKey != "" {
+		key, err := base64.StdEncoding.DecodeString(config.SessionKey)
+		if err != nil {
+			return nil, fmt.Errorf("while decoding session key: %w", err)
+		}
+		a.key = key
+	} else {
+		a.key = make([]byte, 32)
+		if _, err := rand.Read(a.key); err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range config.Tokens {
+		if len(t.Token) < 16 {
+			return nil, fmt.Errorf("token %q is too short, use at least 16 characters", t.Name)
+		}
+		if _, ok := roleLevels[t.Role]; !ok {
+			return nil, fmt.Errorf("token %q has unknown role %q", t.Name, t.Role)
+		}
+	}
+	if config.Google != nil {
+		if config.Google.RedirectURL == "" {
+			return nil, errors.New("google sign in requires a redirect_url")
+		}
+		callback, err := callbackPath(config.Google.RedirectURL)
+		if err != nil {
+			return nil, err
+		}
+		a.callback = callback
+		if len(config.Google.AllowedDomains)+len(config.Google.AllowedEmails)+len(config.Google.AllowedGroups) == 0 {
+			return nil, errors.New("google sign in requires allowed_domains, allowed_emails or allowed_groups")
+		}
+		if googleClient == nil {
+			return nil, errors.New("google sign in requires google client configuration")
+		}
+		var scopes []string
+		if len(config.Google.AllowedGroups) > 0 {
+			scopes = append(scopes, googleGroupsScope)
+		}
+		signIn := googleClient.SignInConfig(config.Google.RedirectURL, scopes...)
+		if signIn == nil {
+			return nil, errors.New("google sign in requires an OAuth client configuration, not a service account")
+		}
+		a.flow = &oauth.Flow{Name: "signin", Config: signIn, PKCE: true}
+	}
+	return a, nil
+}
+
+// sign returns the signature of payload
+func (a *webAuth) sign(payload string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (a *webAuth) encodeSession(u webUser) (string, error) {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + a.sign(payload), nil
+}
+
+func (a *webAuth) decodeSession(value string) (*webUser, error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(a.sign(parts[0]))) {
+		return nil, errors.New("invalid session")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	var u webUser
+	if err := json.Unmarshal(b, &u); err != nil {
+		return nil, err
+	}
+	if time.Now().After(u.Expires) {
+		return nil, errors.New("session expired")
+	}
+	return &u, nil
+}
+
+// authenticate identifies the user making r, if any
+func (a *webAuth) authenticate(r *http.Request) *webUser {
+	if authz := r.Header.Get("Authorization"); strings.HasPrefix(authz, "Bearer ") {
+		presented := []byte(strings.TrimPrefix(authz, "Bearer "))
+		for _, t := range a.config.Tokens {
+			if subtle.ConstantTimeCompare(presented, []byte(t.Token)) == 1 {
+				return &webUser{Email: "token:" + t.Name, Role: t.Role}
+			}
+		}
+		return nil
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if u, err := a.decodeSession(cookie.Value); err == nil {
+			return u
+		}
+	}
+	return nil
+}
+
+// require wraps h, allowing only users with at least role
+func (a *webAuth) require(role string, h http.HandlerFunc) http.HandlerFunc {
+	if a == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := a.authenticate(r)
+		if u == nil {
+			if a.flow != nil && r.Method == http.MethodGet && r.Header.Get("Authorization") == "" {
+				http.Redirect(w, r, "/auth/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		if !u.can(role) {
+			http.Error(w, fmt.Sprintf("%s requires the %s role", r.URL.Path, role), http.StatusForbidden)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), webUserKey{}, u)))
+	}
+}
+
+// sameOrigin reports whether r came from zat's own pages, judging by the headers browsers add to requests.
+// Other clients, eg curl with a bearer token, send neither header and can't be made to by another site.
+func sameOrigin(r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err == nil && u.Host == r.Host
+	}
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin" || site == "none"
+	}
+	return true
+}
+
+// register adds the sign in endpoints to mux
+func (a *webAuth) register(mux *http.ServeMux) {
+	if a == nil {
+		return
+	}
+	mux.HandleFunc("/auth/logout", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+	if a.flow == nil {
+		return
+	}
+	mux.HandleFunc("/auth/login", func(w http.ResponseWriter, r *http.Request) {
+		next := r.FormValue("next")
+		if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+			next = "/"
+		}
+		// remember where to go after signing in, alongside the login state
+		http.SetCookie(w, &http.Cookie{Name: "zat_next", Value: next, Path: "/", MaxAge: int(oauth.StateTTL / time.Second), HttpOnly: true})
+		redirectTo, err := a.flow.AuthCodeURL(w, r, oauth2.SetAuthURLParam("prompt", "select_account"))
+		if err != nil {
+			a.logger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, redirectTo, http.StatusFound)
+	})
+	mux.HandleFunc(a.callback, func(w http.ResponseWriter, r *http.Request) {
+		token, err := a.flow.Exchange(r.Context(), w, r)
+		if err != nil {
+			a.logger.Print("sign in failed: ", err)
+			oauth.ErrorPage(w, "Sign in", err, "/auth/login")
+			return
+		}
+		u, err := a.authorizeGoogle(r.Context(), token)
+		if err != nil {
+			a.logger.Print("sign in denied: ", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		session, err := a.encodeSession(*u)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookie,
+			Value:    session,
+			Path:     "/",
+			Expires:  u.Expires,
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		a.logger.Printf("%s signed in as %s", u.Email, u.Role)
+		next := "/"
+		if c, err := r.Cookie("zat_next"); err == nil && strings.HasPrefix(c.Value, "/") && !strings.HasPrefix(c.Value, "//") {
+			next = c.Value
+		}
+		http.Redirect(w, r, next, http.StatusFound)
+	})
+}
+
+// googleUserInfo is the subset of the OpenID Connect userinfo response needed to authorize a user
+type googleUserInfo struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	HostedDomain  string `json:"hd"`
+}
+
+// getJSON fetches url with token, decoding the response into v
+func (a *webAuth) getJSON(ctx context.Context, token *oauth2.Token, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	token.SetAuthHeader(req)
+	rsp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, rsp.Status)
+	}
+	return json.NewDecoder(rsp.Body).Decode(v)
+}
+
+// authorizeGoogle checks the signed in google user against the allowed lists
+func (a *webAuth) authorizeGoogle(ctx context.Context, token *oauth2.Token) (*webUser, error) {
+	var info googleUserInfo
+	if err := a.getJSON(ctx, token, googleUserInfoURL, &info); err != nil {
+		return nil, fmt.Errorf("while fetching user info: %w", err)
+	}
+	if info.Email == "" || !info.EmailVerified {
+		return nil, errors.New("a verified email address is required")
+	}
+	email := strings.ToLower(info.Email)
+	cfg := a.config.Google
+	allowed := false
+	for _, e := range cfg.AllowedEmails {
+		allowed = allowed || strings.EqualFold(e, email)
+	}
+	for _, d := range cfg.AllowedDomains {
+		allowed = allowed || strings.EqualFold(d, info.HostedDomain)
+	}
+	for _, g := range cfg.AllowedGroups {
+		if allowed {
+			break
+		}
+		member, err := a.isGroupMember(ctx, token, g, email)
+		if err != nil {
+			a.logger.Printf("failed to check %s membership of %s: %s", email, g, err)
+			continue
+		}
+		allowed = member
+	}
+	if !allowed {
+		return nil, fmt.Errorf("%s is not allowed to sign in", email)
+	}
+	u := &webUser{Email: email, Role: roleViewer, Expires: time.Now().Add(sessionTTL)}
+	for _, o := range cfg.Operators {
+		if strings.EqualFold(o, email) {
+			u.Role = roleOperator
+		}
+	}
+	return u, nil
+}
+
+// isGroupMember checks, as the signed in user, for transitive membership of a google group
+// https://cloud.google.com/identity/docs/how-to/query-memberships
+func (a *webAuth) isGroupMember(ctx context.Context, token *oauth2.Token, group, email string) (bool, error) {
+	var lookup struct {
+		Name string `json:"name"`
+	}
+	if err := a.getJSON(ctx, token, cloudIdentityBaseURL+"groups:lookup?groupKey.id="+url.QueryEscape(group), &lookup); err != nil {
+		return false, err
+	}
+	var check struct {
+		HasMembership bool `json:"hasMembership"`
+	}
+	query := url.Values{"query": []string{fmt.Sprintf("member_key_id == '%s'", email)}}
+	if err := a.getJSON(ctx, token, cloudIdentityBaseURL+lookup.Name+"/memberships:checkTransitiveMembership?"+query.Encode(), &check); err != nil {
+		return false, err
+	}
+	return check.HasMembership, nil
+}
@@ -0,0 +1,161 @@
+// Package chatlog reads the in-meeting chat saved by zoom cloud recordings.
+package chatlog
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/graphaelli/zat/zoom/vtt"
+)
+
+// Message is a single chat message.
+type Message struct {
+	// Offset is the time the message was sent, relative to the start of the recording
+	Offset time.Duration
+	From   string
+	// To is the recipient, eg "Everyone", when recorded
+	To   string
+	Text string
+}
+
+// Private reports whether m was sent to someone directly, rather than to everyone
+func (m Message) Private() bool {
+	return m.To != "" && !strings.EqualFold(m.To, "everyone")
+}
+
+// zoom has written a few variations over time:
+//
+//	00:01:23	 From  Alice Smith : hello
+//	00:01:23 From Alice Smith to Everyone : hello
+//	00:01:23 From Alice Smith to Everyone:
+//		hello
+var lineRe = regexp.MustCompile(`^(\d{1,2}:\d{2}:\d{2})\s+From\s+(.+?)(?:\s+[tT]o\s+(.+?))?\s*:(?:\s+(.*))?$`)
+
+// Parse reads all messages from a chat log.
+// Lines that don't start a new message are continuations of the previous message.
+func Parse(r io.Reader) ([]Message, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var messages []Message
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if lineNo == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		if m := lineRe.FindStringSubmatch(line); m != nil {
+			offset, err := parseOffset(m[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			messages = append(messages, Message{
+				Offset: offset,
+				From:   strings.TrimSpace(m[2]),
+				To:     strings.TrimSpace(m[3]),
+				Text:   strings.TrimSpace(m[4]),
+			})
+			continue
+		}
+		text := strings.TrimSpace(line)
+		if text == "" {
+			continue
+		}
+		if len(messages) == 0 {
+			return nil, fmt.Errorf("line %d: unrecognized chat message %q", lineNo, line)
+		}
+		last := &messages[len(messages)-1]
+		if last.Text != "" {
+			last.Text += "\n"
+		}
+		last.Text += text
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func parseOffset(s string) (time.Duration, error) {
+	var h, m, sec int
+	if _, err := fmt.Sscanf(s, "%d:%d:%d", &h, &m, &sec); err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second, nil
+}
+
+var linkRe = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// findLinks returns the URLs in text, without trailing punctuation.
+func findLinks(text string) []string {
+	links := linkRe.FindAllString(text, -1)
+	for i, l := range links {
+		links[i] = strings.TrimRight(l, ".,;:!?)]}'")
+	}
+	return links
+}
+
+// Link is a URL shared in chat.
+type Link struct {
+	Message Message
+	URL     string
+}
+
+// Links returns every URL shared with everyone in messages, in order, the first time each was shared.
+// Links in private messages are left out.
+func Links(messages []Message) []Link {
+	seen := map[string]bool{}
+	var links []Link
+	for _, m := range messages {
+		if m.Private() {
+			continue
+		}
+		for _, l := range findLinks(m.Text) {
+			if seen[l] {
+				continue
+			}
+			seen[l] = true
+			links = append(links, Link{Message: m, URL: l})
+		}
+	}
+	return links
+}
+
+// linkify escapes text for html, turning URLs into links
+func linkify(text string) string {
+	var b strings.Builder
+	for {
+		loc := linkRe.FindStringIndex(text)
+		if loc == nil {
+			break
+		}
+		url := strings.TrimRight(text[loc[0]:loc[1]], ".,;:!?)]}'")
+		b.WriteString(html.EscapeString(text[:loc[0]]))
+		fmt.Fprintf(&b, "<a href=\"%s\">%s</a>", html.EscapeString(url), html.EscapeString(url))
+		text = text[loc[0]+len(url):]
+	}
+	b.WriteString(html.EscapeString(text))
+	return strings.ReplaceAll(b.String(), "\n", "<br>")
+}
+
+// RenderHTML writes messages as a standalone html document, suitable for conversion to a Google Doc.
+// offset is added to each message time, eg to display times relative to the meeting rather than the recording.
+func RenderHTML(w io.Writer, title string, offset time.Duration, messages []Message) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "<html><head><meta charset=\"utf-8\"><title>%s</title></head><body>\n<h1>%s</h1>\n",
+		html.EscapeString(title), html.EscapeString(title))
+	for _, m := range messages {
+		fmt.Fprintf(bw, "<p><span style=\"color:#666666\">%s</span> <b>%s</b>", vtt.FormatOffset(m.Offset+offset), html.EscapeString(m.From))
+		if m.Private() {
+			fmt.Fprintf(bw, " to <b>%s</b>", html.EscapeString(m.To))
+		}
+		fmt.Fprintf(bw, ": %s</p>\n", linkify(m.Text))
+	}
+	fmt.Fprint(bw, "</body></html>\n")
+	return bw.Flush()
+}
@@ -0,0 +1,44 @@
+package chatlog
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	log := "00:01:23\t From  Alice Smith : see https://example.com/a.\n" +
+		"00:02:00 From Bob to Everyone:\n" +
+		"\tfirst line\n" +
+		"\tsecond line https://example.com/b\n" +
+		"01:02:03 From Carol To Alice Smith(Direct Message) : psst https://example.com/private\n"
+	messages, err := Parse(strings.NewReader(log))
+	require.NoError(t, err)
+	assert.Equal(t, []Message{
+		{Offset: 83 * time.Second, From: "Alice Smith", Text: "see https://example.com/a."},
+		{Offset: 2 * time.Minute, From: "Bob", To: "Everyone", Text: "first line\nsecond line https://example.com/b"},
+		{Offset: time.Hour + 2*time.Minute + 3*time.Second, From: "Carol", To: "Alice Smith(Direct Message)", Text: "psst https://example.com/private"},
+	}, messages)
+
+	// the direct message's link isn't shared
+	links := Links(append(messages, Message{From: "Dan", Text: "again https://example.com/a"}))
+	require.Len(t, links, 2)
+	assert.Equal(t, "https://example.com/a", links[0].URL)
+	assert.Equal(t, "Alice Smith", links[0].Message.From)
+	assert.Equal(t, "https://example.com/b", links[1].URL)
+
+	var buf bytes.Buffer
+	require.NoError(t, RenderHTML(&buf, "Some Meeting", time.Minute, messages))
+	assert.Contains(t, buf.String(), `<p><span style="color:#666666">0:02:23</span> <b>Alice Smith</b>: see <a href="https://example.com/a">https://example.com/a</a>.</p>`)
+	assert.Contains(t, buf.String(), `<b>Bob</b>: first line<br>second line <a href="https://example.com/b">https://example.com/b</a></p>`)
+	assert.Contains(t, buf.String(), `<b>Carol</b> to <b>Alice Smith(Direct Message)</b>: psst <a href="https://example.com/private">https://example.com/private</a></p>`)
+}
+
+func TestParseInvalid(t *testing.T) {
+	_, err := Parse(strings.NewReader("hello\n"))
+	assert.Error(t, err)
+}
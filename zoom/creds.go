@@ -1,46 +1,24 @@
 package zoom
 
 import (
-	"encoding/json"
-	"os"
-
-	"golang.org/x/oauth2"
+	"github.com/graphaelli/zat/oauth"
 )
 
 type credentialsManager struct {
-	path string
+	store oauth.Store
 }
 
+// NewCredentialsManager persists credentials as plaintext at path
 func NewCredentialsManager(path string) *credentialsManager {
-	return &credentialsManager{path: path}
-}
-
-func (cm *credentialsManager) loadCreds(c *Client) error {
-	f, err := os.Open(cm.path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	var token oauth2.Token
-	if err := json.NewDecoder(f).Decode(&token); err != nil {
-		return err
-	}
-	c.credentials = &token
-	return nil
+	return NewCredentialsManagerFromStore(oauth.FileStore{Path: path})
 }
 
-func (cm *credentialsManager) saveCreds(c *Client) error {
-	f, err := os.OpenFile(cm.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	return json.NewEncoder(f).Encode(c.credentials)
+func NewCredentialsManagerFromStore(store oauth.Store) *credentialsManager {
+	return &credentialsManager{store: store}
 }
 
 func (cm *credentialsManager) ClientOption(c *Client) {
-	c.cm = cm
-	if err := c.cm.loadCreds(c); err != nil {
+	if err := c.tokens.SetStore(cm.store); err != nil {
 		c.logger.Println("failed to load creds:", err)
 	}
 }
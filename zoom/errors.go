@@ -0,0 +1,152 @@
+package zoom
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultMaxRetries is how many times a failed API call is retried
+	DefaultMaxRetries = 4
+	// DefaultRetryBackoff is the initial wait between retries, doubling after each attempt
+	DefaultRetryBackoff = time.Second
+	// MaxRetryWait caps how long a single retry waits, longer Retry-After values are not retried
+	MaxRetryWait = 2 * time.Minute
+
+	// RateLimitDaily is the X-RateLimit-Type reported once the daily request quota is used up
+	RateLimitDaily = "Daily-limit"
+	// RateLimitQPS is the X-RateLimit-Type reported when requests are too frequent
+	RateLimitQPS = "QPS"
+)
+
+var (
+	ErrUnauthorized = errors.New("zoom: unauthorized")
+	ErrForbidden    = errors.New("zoom: forbidden")
+	ErrNotFound     = errors.New("zoom: not found")
+	ErrRateLimited  = errors.New("zoom: rate limited")
+)
+
+// APIError is a failed zoom API call.
+// https://marketplace.zoom.us/docs/api-reference/error-definitions
+type APIError struct {
+	// URL of the request, without credentials
+	URL        string
+	StatusCode int
+	// Code and Message are zoom's error details, when provided
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// RateLimitType and RetryAfter are set when rate limited
+	RateLimitType string
+	RetryAfter    time.Duration
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("API call to %s failed: %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Code != 0 {
+		msg += fmt.Sprintf(": code %d", e.Code)
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.RateLimitType != "" {
+		msg += fmt.Sprintf(" (%s rate limit)", e.RateLimitType)
+	}
+	return msg
+}
+
+// Is matches the sentinel errors by status code, for use with errors.Is.
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// Temporary reports whether the call may succeed if retried.
+// Exhausting the daily quota is not temporary as far as a single run is concerned.
+func (e *APIError) Temporary() bool {
+	if e.StatusCode == http.StatusTooManyRequests {
+		return e.RateLimitType != RateLimitDaily && e.RetryAfter <= MaxRetryWait
+	}
+	return e.StatusCode >= http.StatusInternalServerError
+}
+
+// newAPIError decodes the error details from a failed response, body may be empty or not JSON.
+func newAPIError(url string, rsp *http.Response, body []byte) *APIError {
+	e := &APIError{}
+	if len(body) > 0 && json.Unmarshal(body, e) != nil {
+		e.Message = string(body)
+	}
+	e.URL = url
+	e.StatusCode = rsp.StatusCode
+	e.RateLimitType = rsp.Header.Get("X-RateLimit-Type")
+	e.RetryAfter = parseRetryAfter(rsp.Header.Get("Retry-After"), time.Now())
+	return e
+}
+
+// parseRetryAfter accepts either delay seconds or a date, zoom also sends RFC 3339 timestamps.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	for _, layout := range []string{http.TimeFormat, time.RFC3339} {
+		if t, err := time.Parse(layout, value); err == nil {
+			if d := t.Sub(now); d > 0 {
+				return d
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// RetryOption configures how failed API calls are retried, maxRetries of 0 disables retries.
+func RetryOption(maxRetries int, backoff time.Duration) ClientOption {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.retryBackoff = backoff
+	}
+}
+
+// retryWait computes the wait before retrying attempt, preferring the server's Retry-After.
+func (c *Client) retryWait(e *APIError, attempt int) (time.Duration, bool) {
+	if attempt >= c.maxRetries || !e.Temporary() {
+		return 0, false
+	}
+	if e.RetryAfter > 0 {
+		return e.RetryAfter, true
+	}
+	wait := c.retryBackoff << uint(attempt)
+	if wait <= 0 || wait > MaxRetryWait {
+		wait = MaxRetryWait
+	}
+	// jitter spreads out retries from concurrent callers
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1)), true
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"testing"
 
+	"github.com/graphaelli/zat/oauth"
 	"github.com/graphaelli/zat/zoom"
 )
 
@@ -48,18 +49,29 @@ func OauthHandler(t *testing.T, oauthRedirect string) func(w http.ResponseWriter
 		t.Error(err)
 	}
 
+	// PKCE challenge of the last authorization request
+	var challenge string
 	return func(w http.ResponseWriter, r *http.Request) {
 		t.Log("mock zoom handler handling", r.URL.String())
 		if r.URL.Path == "/oauth/authorize" {
 			next := *u
 			v := next.Query()
 			v.Set("code", "acode")
+			if state := r.FormValue("state"); state != "" {
+				v.Set("state", state)
+			}
 			next.RawQuery = v.Encode()
+			challenge = r.FormValue("code_challenge")
 			http.Redirect(w, r, next.String(), http.StatusFound)
 			return
 		}
 
 		if r.URL.Path == "/oauth/token" {
+			if challenge != "" && oauth.S256Challenge(r.FormValue("code_verifier")) != challenge {
+				t.Error("PKCE code verifier doesn't match challenge")
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
 			w.Header().Set("Content-Type", "application/json")
 			if err := json.NewEncoder(w).Encode(OauthResponse{
 				AccessToken:  "test_access_token",
@@ -0,0 +1,93 @@
+package vtt
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"time"
+)
+
+// Paragraph is a run of consecutive cues from the same speaker.
+type Paragraph struct {
+	Start   time.Duration
+	End     time.Duration
+	Speaker string
+	Text    string
+}
+
+// Paragraphs groups consecutive cues by speaker.
+// Captions without speakers are grouped into paragraphs spanning at most maxGap between cues.
+func Paragraphs(cues []Cue) []Paragraph {
+	const maxGap = 5 * time.Second
+	var paragraphs []Paragraph
+	for _, cue := range cues {
+		text := strings.Join(strings.Fields(cue.Text), " ")
+		if text == "" {
+			continue
+		}
+		if n := len(paragraphs); n > 0 {
+			last := &paragraphs[n-1]
+			if last.Speaker == cue.Speaker && (cue.Speaker != "" || cue.Start-last.End <= maxGap) {
+				last.Text += " " + text
+				last.End = cue.End
+				continue
+			}
+		}
+		paragraphs = append(paragraphs, Paragraph{Start: cue.Start, End: cue.End, Speaker: cue.Speaker, Text: text})
+	}
+	return paragraphs
+}
+
+// FormatOffset formats d for display, h:mm:ss
+func FormatOffset(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	s := int64(d / time.Second)
+	return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+}
+
+// RenderText writes paragraphs as plain text, one paragraph per line.
+func RenderText(w io.Writer, paragraphs []Paragraph) error {
+	bw := bufio.NewWriter(w)
+	for _, p := range paragraphs {
+		if p.Speaker != "" {
+			fmt.Fprintf(bw, "[%s] %s: %s\n", FormatOffset(p.Start), p.Speaker, p.Text)
+		} else {
+			fmt.Fprintf(bw, "[%s] %s\n", FormatOffset(p.Start), p.Text)
+		}
+	}
+	return bw.Flush()
+}
+
+// RenderMarkdown writes paragraphs as markdown under a title heading.
+func RenderMarkdown(w io.Writer, title string, paragraphs []Paragraph) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# %s\n", title)
+	for _, p := range paragraphs {
+		if p.Speaker != "" {
+			fmt.Fprintf(bw, "\n`%s` **%s**: %s\n", FormatOffset(p.Start), p.Speaker, p.Text)
+		} else {
+			fmt.Fprintf(bw, "\n`%s` %s\n", FormatOffset(p.Start), p.Text)
+		}
+	}
+	return bw.Flush()
+}
+
+// RenderHTML writes paragraphs as a standalone html document, suitable for conversion to a Google Doc.
+func RenderHTML(w io.Writer, title string, paragraphs []Paragraph) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "<html><head><meta charset=\"utf-8\"><title>%s</title></head><body>\n<h1>%s</h1>\n",
+		html.EscapeString(title), html.EscapeString(title))
+	for _, p := range paragraphs {
+		fmt.Fprintf(bw, "<p><span style=\"color:#666666\">%s</span> ", FormatOffset(p.Start))
+		if p.Speaker != "" {
+			fmt.Fprintf(bw, "<b>%s</b>: ", html.EscapeString(p.Speaker))
+		}
+		fmt.Fprintf(bw, "%s</p>\n", html.EscapeString(p.Text))
+	}
+	fmt.Fprint(bw, "</body></html>\n")
+	return bw.Flush()
+}
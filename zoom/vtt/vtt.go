@@ -0,0 +1,199 @@
+// Package vtt reads and writes the WebVTT transcripts and closed captions produced by zoom cloud recordings.
+// https://www.w3.org/TR/webvtt1/
+package vtt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const header = "WEBVTT"
+
+// Cue is a single timed caption.
+type Cue struct {
+	ID    string
+	Start time.Duration
+	End   time.Duration
+	// Speaker is split from text prefixed with "Name: ", as zoom does for transcripts
+	Speaker string
+	Text    string
+}
+
+// Parse reads all cues from a WebVTT file.
+func Parse(r io.Reader) ([]Cue, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var lines []string
+	lineNo := 0
+	sawHeader := false
+	var cues []Cue
+	flush := func() error {
+		defer func() { lines = lines[:0] }()
+		if len(lines) == 0 {
+			return nil
+		}
+		if !sawHeader {
+			// the first block holds the file header, possibly after a byte order mark
+			if !strings.HasPrefix(strings.TrimPrefix(lines[0], "\ufeff"), header) {
+				return fmt.Errorf("missing %s header", header)
+			}
+			sawHeader = true
+			return nil
+		}
+		if strings.HasPrefix(lines[0], "NOTE") || lines[0] == "STYLE" || lines[0] == "REGION" {
+			return nil
+		}
+		var cue Cue
+		timing := lines[0]
+		text := lines[1:]
+		if !strings.Contains(timing, "-->") {
+			if len(lines) < 2 {
+				return fmt.Errorf("line %d: cue %q missing timing", lineNo, lines[0])
+			}
+			cue.ID = lines[0]
+			timing = lines[1]
+			text = lines[2:]
+		}
+		var err error
+		if cue.Start, cue.End, err = parseTiming(timing); err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		cue.Speaker, cue.Text = splitSpeaker(strings.Join(text, "\n"))
+		cues = append(cues, cue)
+		return nil
+	}
+
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	if !sawHeader {
+		return nil, fmt.Errorf("missing %s header", header)
+	}
+	return cues, nil
+}
+
+func parseTiming(line string) (time.Duration, time.Duration, error) {
+	parts := strings.SplitN(line, "-->", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("cue timing %q missing -->", line)
+	}
+	start, err := ParseTimestamp(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, err
+	}
+	// cue settings may follow the end timestamp
+	fields := strings.Fields(parts[1])
+	if len(fields) == 0 {
+		return 0, 0, fmt.Errorf("cue timing %q has no end", line)
+	}
+	end, err := ParseTimestamp(fields[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+// ParseTimestamp parses a WebVTT timestamp, [hh:]mm:ss.ttt
+func ParseTimestamp(s string) (time.Duration, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) < 2 || len(fields) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	var d time.Duration
+	for i, f := range fields {
+		unit := time.Minute
+		if len(fields) == 3 && i == 0 {
+			unit = time.Hour
+		}
+		if i == len(fields)-1 {
+			seconds, err := strconv.ParseFloat(f, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid timestamp %q", s)
+			}
+			d += time.Duration(seconds * float64(time.Second))
+			break
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		d += time.Duration(n) * unit
+	}
+	return d.Round(time.Millisecond), nil
+}
+
+// FormatTimestamp formats d as a WebVTT timestamp, hh:mm:ss.ttt
+func FormatTimestamp(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// splitSpeaker separates a "Name: text" prefix
+func splitSpeaker(text string) (string, string) {
+	i := strings.Index(text, ": ")
+	if i <= 0 || i > 64 || strings.ContainsAny(text[:i], "\n") {
+		return "", text
+	}
+	return text[:i], text[i+2:]
+}
+
+// Write encodes cues as a WebVTT file.
+func Write(w io.Writer, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s\n", header)
+	for _, cue := range cues {
+		fmt.Fprintln(bw)
+		if cue.ID != "" {
+			fmt.Fprintln(bw, cue.ID)
+		}
+		fmt.Fprintf(bw, "%s --> %s\n", FormatTimestamp(cue.Start), FormatTimestamp(cue.End))
+		if cue.Speaker != "" {
+			fmt.Fprintf(bw, "%s: ", cue.Speaker)
+		}
+		fmt.Fprintln(bw, cue.Text)
+	}
+	return bw.Flush()
+}
+
+// Trim keeps the cues between start and end, when end is positive, moving them earlier by start.
+// Cues partly outside are cut short.
+func Trim(cues []Cue, start, end time.Duration) []Cue {
+	var kept []Cue
+	for _, cue := range cues {
+		if cue.End <= start || (end > 0 && cue.Start >= end) {
+			continue
+		}
+		if cue.Start < start {
+			cue.Start = start
+		}
+		if end > 0 && cue.End > end {
+			cue.End = end
+		}
+		cue.Start -= start
+		cue.End -= start
+		kept = append(kept, cue)
+	}
+	return kept
+}
@@ -0,0 +1,109 @@
+package vtt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const transcript = `WEBVTT
+
+1
+00:00:02.340 --> 00:00:05.670
+Alice Smith: Good morning everyone.
+
+2
+00:00:05.900 --> 00:00:08.000
+Alice Smith: Let's get started.
+
+NOTE zoom doesn't write these, others might
+
+3
+00:01:01.000 --> 01:00:03.500 align:start
+Bob: Thanks Alice,
+see https://example.com/doc: the doc
+`
+
+func TestParse(t *testing.T) {
+	cues, err := Parse(strings.NewReader(transcript))
+	require.NoError(t, err)
+	assert.Equal(t, []Cue{
+		{ID: "1", Start: 2340 * time.Millisecond, End: 5670 * time.Millisecond, Speaker: "Alice Smith", Text: "Good morning everyone."},
+		{ID: "2", Start: 5900 * time.Millisecond, End: 8 * time.Second, Speaker: "Alice Smith", Text: "Let's get started."},
+		{ID: "3", Start: 61 * time.Second, End: time.Hour + 3500*time.Millisecond, Speaker: "Bob", Text: "Thanks Alice,\nsee https://example.com/doc: the doc"},
+	}, cues)
+}
+
+func TestParseInvalid(t *testing.T) {
+	for name, input := range map[string]string{
+		"empty":     "",
+		"no header": "1\n00:00:01.000 --> 00:00:02.000\nhi\n",
+		"timestamp": "WEBVTT\n\n1\n00:0x:01.000 --> 00:00:02.000\nhi\n",
+		"no end":    "WEBVTT\n\n1\n00:00:01.000 -->\nhi\n",
+		"no arrow":  "WEBVTT\n\nfoo\n00:01.000\nhi\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(input))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	cues, err := Parse(strings.NewReader(transcript))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, cues))
+	assert.True(t, strings.HasPrefix(buf.String(), "WEBVTT\n\n1\n00:00:02.340 --> 00:00:05.670\nAlice Smith: Good morning everyone.\n"))
+	again, err := Parse(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, cues, again)
+}
+
+func TestTrim(t *testing.T) {
+	cues, err := Parse(strings.NewReader(transcript))
+	require.NoError(t, err)
+	trimmed := Trim(cues, 5*time.Second, time.Minute+2*time.Second)
+	require.Len(t, trimmed, 3)
+	assert.Equal(t, time.Duration(0), trimmed[0].Start, "cut short")
+	assert.Equal(t, 670*time.Millisecond, trimmed[0].End)
+	assert.Equal(t, 900*time.Millisecond, trimmed[1].Start)
+	assert.Equal(t, 3*time.Second, trimmed[1].End)
+	assert.Equal(t, 56*time.Second, trimmed[2].Start)
+	assert.Equal(t, 57*time.Second, trimmed[2].End, "cut short")
+	assert.Empty(t, Trim(cues, 10*time.Second, 20*time.Second))
+
+	// without an end only the start is trimmed
+	trimmed = Trim(cues, 3*time.Second, 0)
+	require.Len(t, trimmed, 3)
+	assert.Equal(t, time.Duration(0), trimmed[0].Start)
+	assert.Equal(t, 2670*time.Millisecond, trimmed[0].End)
+	assert.Equal(t, time.Hour+500*time.Millisecond, trimmed[2].End)
+	assert.Equal(t, cues, Trim(cues, 0, 0))
+}
+
+func TestRender(t *testing.T) {
+	cues, err := Parse(strings.NewReader(transcript))
+	require.NoError(t, err)
+	paragraphs := Paragraphs(cues)
+	require.Len(t, paragraphs, 2)
+
+	var buf bytes.Buffer
+	require.NoError(t, RenderText(&buf, paragraphs))
+	assert.Equal(t, "[0:00:02] Alice Smith: Good morning everyone. Let's get started.\n"+
+		"[0:01:01] Bob: Thanks Alice, see https://example.com/doc: the doc\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, RenderMarkdown(&buf, "Some Meeting", paragraphs))
+	assert.Equal(t, "# Some Meeting\n\n`0:00:02` **Alice Smith**: Good morning everyone. Let's get started.\n\n"+
+		"`0:01:01` **Bob**: Thanks Alice, see https://example.com/doc: the doc\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, RenderHTML(&buf, "Some <Meeting>", paragraphs))
+	assert.Contains(t, buf.String(), "<h1>Some &lt;Meeting&gt;</h1>")
+	assert.Contains(t, buf.String(), "<b>Bob</b>: Thanks Alice, see https://example.com/doc: the doc</p>")
+}
@@ -12,9 +12,12 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"golang.org/x/oauth2"
+
+	"github.com/graphaelli/zat/oauth"
 )
 
 const (
@@ -36,10 +39,12 @@ type RecordingFile struct {
 }
 
 type Meeting struct {
-	UUID           string          `json:"uuid"`
-	ID             int64           `json:"id"`
-	AccountID      string          `json:"account_id"`
-	HostID         string          `json:"host_id"`
+	UUID      string `json:"uuid"`
+	ID        int64  `json:"id"`
+	AccountID string `json:"account_id"`
+	HostID    string `json:"host_id"`
+	// HostEmail is provided in webhook payloads
+	HostEmail      string          `json:"host_email,omitempty"`
 	Topic          string          `json:"topic"`
 	Type           int             `json:"type"`
 	StartTime      time.Time       `json:"start_time"`
@@ -49,6 +54,10 @@ type Meeting struct {
 	RecordingCount int             `json:"recording_count"`
 	ShareURL       string          `json:"share_url"`
 	RecordingFiles []RecordingFile `json:"recording_files"`
+	// RecordingPlayPasscode is set when recordings are passcode protected
+	RecordingPlayPasscode string `json:"recording_play_passcode,omitempty"`
+	// DownloadAccessToken is provided in webhook payloads, valid for downloading this meeting's recordings
+	DownloadAccessToken string `json:"download_access_token,omitempty"`
 }
 
 type ListRecordingsResponse struct {
@@ -61,14 +70,53 @@ type ListRecordingsResponse struct {
 	Meetings      []Meeting `json:"meetings"`
 }
 
+type Registrant struct {
+	ID        string `json:"id"`
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Status    string `json:"status"`
+}
+
+type ListRegistrantsResponse struct {
+	PageCount     int          `json:"page_count"`
+	PageSize      int          `json:"page_size"`
+	TotalRecords  int          `json:"total_records"`
+	NextPageToken string       `json:"next_page_token"`
+	Registrants   []Registrant `json:"registrants"`
+}
+
+// Participant is an attendee of a past meeting.
+// Join and leave times are only provided by the participants report, attendees rejoining are listed once per session.
+type Participant struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id,omitempty"`
+	Name      string    `json:"name"`
+	UserEmail string    `json:"user_email"`
+	JoinTime  time.Time `json:"join_time,omitempty"`
+	LeaveTime time.Time `json:"leave_time,omitempty"`
+	Duration  int       `json:"duration,omitempty"`
+}
+
+type ListParticipantsResponse struct {
+	PageCount     int           `json:"page_count"`
+	PageSize      int           `json:"page_size"`
+	TotalRecords  int           `json:"total_records"`
+	NextPageToken string        `json:"next_page_token"`
+	Participants  []Participant `json:"participants"`
+}
+
 type Client struct {
 	logger     *log.Logger
 	httpClient *http.Client
 
-	apiBaseUrl  *url.URL
-	config      *oauth2.Config
-	credentials *oauth2.Token
-	cm          *credentialsManager
+	apiBaseUrl *url.URL
+	config     *oauth2.Config
+	tokens     *oauth.TokenSource
+	login      *oauth.Flow
+
+	maxRetries   int
+	retryBackoff time.Duration
 }
 
 type ClientOption func(*Client)
@@ -129,6 +177,9 @@ func NewClient(logger *log.Logger, config Config, options ...ClientOption) (*Cli
 		logger:     logger,
 		httpClient: http.DefaultClient,
 
+		maxRetries:   DefaultMaxRetries,
+		retryBackoff: DefaultRetryBackoff,
+
 		apiBaseUrl: apiUrl,
 		config: &oauth2.Config{
 			ClientID:     config.Id,
@@ -140,84 +191,113 @@ func NewClient(logger *log.Logger, config Config, options ...ClientOption) (*Cli
 			RedirectURL: config.OauthRedirect,
 		},
 	}
+	c.tokens = oauth.NewTokenSource(logger, "Zoom", c.config)
+	c.login = &oauth.Flow{Name: "zoom", Config: c.config, PKCE: true}
 
 	for _, o := range options {
 		o(c)
 	}
+	c.tokens.SetHTTPClient(c.httpClient)
 	return c, nil
 }
 
 func (c *Client) updateCreds(token *oauth2.Token) {
-	c.credentials = token
-	if token != nil && c.cm != nil {
-		if err := c.cm.saveCreds(c); err != nil {
-			c.logger.Println("failed to save creds:", err)
-		}
-	}
+	c.tokens.Set(token)
 }
 
+// HasCreds reports whether usable credentials are available, refreshing them if needed.
 func (c *Client) HasCreds() bool {
-	if c.credentials == nil {
-		return false
-	}
+	return c.tokens.Valid()
+}
 
-	valid := c.credentials.Valid()
+// TokenStatus reports the outcome of the last token refresh.
+func (c *Client) TokenStatus() (time.Time, error) {
+	return c.tokens.Status()
+}
 
-	if !valid {
-		c.logger.Println("Zoom credentials not valid, updating token")
-		src := c.config.TokenSource(context.TODO(), c.credentials)
-		newToken, err := src.Token() // this actually goes and renews the tokens
-		if err != nil {
-			c.logger.Printf("error updating google token %s", err)
-			return false
-		}
-		if newToken.AccessToken != c.credentials.AccessToken {
-			c.updateCreds(newToken)
-			c.credentials = newToken
-			c.logger.Println("Zoom credentials updated and saved to disk")
-		}
-	}
-	return true
+// RefreshInBackground keeps credentials fresh until ctx is done.
+func (c *Client) RefreshInBackground(ctx context.Context, onError func(error)) {
+	go c.tokens.Run(ctx, onError)
 }
 
 func (c *Client) OauthRedirect(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, c.config.RedirectURL, http.StatusFound)
 }
 
-func (c *Client) addBearerAuth(r *http.Request) {
-	r.Header.Set("Authorization", "Bearer "+c.credentials.AccessToken)
-}
-
-func (c *Client) AccessToken() string {
-	return c.credentials.AccessToken
+func (c *Client) addBearerAuth(r *http.Request) error {
+	token, err := c.tokens.Token()
+	if err != nil {
+		return err
+	}
+	token.SetAuthHeader(r)
+	return nil
 }
 
+// NewApiRequest builds a request for uri, relative to the API base URL.
+// uri must already be escaped, see EncodeUUID.
 func (c *Client) NewApiRequest(ctx context.Context, method, uri string) (*http.Request, error) {
 	u := *c.apiBaseUrl
-	u.Path = path.Join(u.Path, uri)
+	u.RawPath = path.Join(c.apiBaseUrl.EscapedPath(), uri)
+	p, err := url.PathUnescape(u.RawPath)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = p
 	req, err := http.NewRequest(method, u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
-	if c.HasCreds() {
-		c.addBearerAuth(req)
+	if err := c.addBearerAuth(req); err != nil && err != oauth.ErrNoToken {
+		return nil, err
 	}
 	return req.WithContext(ctx), nil
 }
 
+// Do executes req, decoding the response into decodeTo.
+// Failed calls are returned as *APIError. Rate limited and server errors are retried with backoff,
+// and a rejected access token is refreshed once.
 func (c *Client) Do(req *http.Request, decodeTo interface{}) (*http.Response, error) {
+	ctx := req.Context()
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		rsp, err := c.do(req.Clone(ctx), decodeTo)
+		var apiErr *APIError
+		if err == nil || !errors.As(err, &apiErr) {
+			return rsp, err
+		}
+		if apiErr.StatusCode == http.StatusUnauthorized && !refreshed {
+			refreshed = true
+			if rerr := c.tokens.Refresh(ctx); rerr != nil {
+				return nil, err
+			}
+			if rerr := c.addBearerAuth(req); rerr != nil {
+				return nil, err
+			}
+			c.logger.Printf("retrying %s with refreshed credentials", req.URL)
+			continue
+		}
+		wait, retry := c.retryWait(apiErr, attempt)
+		if !retry {
+			return nil, err
+		}
+		c.logger.Printf("%s, retrying in %s", err, wait.Round(time.Millisecond))
+		if serr := sleep(ctx, wait); serr != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *Client) do(req *http.Request, decodeTo interface{}) (*http.Response, error) {
 	rsp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("while creating http client in Do: %w", err)
 	}
 	defer rsp.Body.Close()
 	if rsp.StatusCode != http.StatusOK {
-		msg := fmt.Sprintf("API call to %s failed: %d", req.URL.String(), rsp.StatusCode)
-		if body, err := ioutil.ReadAll(rsp.Body); err == nil {
-			msg += ": " + string(body)
-		}
-		c.logger.Print(msg)
-		return nil, errors.New(msg)
+		body, _ := ioutil.ReadAll(rsp.Body)
+		apiErr := newAPIError(req.URL.String(), rsp, body)
+		c.logger.Print(apiErr)
+		return nil, apiErr
 	}
 
 	d := json.NewDecoder(rsp.Body)
@@ -227,24 +307,37 @@ func (c *Client) Do(req *http.Request, decodeTo interface{}) (*http.Response, er
 	return rsp, nil
 }
 
+// LoginFlow is the login flow, for logging in from a terminal, along with the options it needs to obtain a refresh token.
+func (c *Client) LoginFlow() (*oauth.Flow, []oauth2.AuthCodeOption) {
+	return c.login, []oauth2.AuthCodeOption{oauth2.AccessTypeOffline}
+}
+
+// SetCreds replaces the credentials after a login, persisting them.
+func (c *Client) SetCreds(token *oauth2.Token) error {
+	c.updateCreds(token)
+	_, err := c.tokens.Status()
+	return err
+}
+
 func (c *Client) OauthHandler() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.FormValue("refresh") != "" || (c.credentials != nil && c.credentials.Expiry.Before(time.Now())) {
-			c.updateCreds(nil)
-		}
-
-		code := r.FormValue("code")
-		if code == "" {
-			redirectTo := c.config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
+		// current credentials are kept until the login succeeds, replacing them
+		if !oauth.IsCallback(r) {
+			redirectTo, err := c.login.AuthCodeURL(w, r, oauth2.AccessTypeOffline)
+			if err != nil {
+				c.logger.Print(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 			c.logger.Print("no code provided, sending to zoom auth ", redirectTo)
 			http.Redirect(w, r, redirectTo, http.StatusFound)
 			return
 		}
 
 		// exchange for token
-		if token, err := c.config.Exchange(context.TODO(), code); err != nil {
-			c.logger.Print(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if token, err := c.login.Exchange(r.Context(), w, r); err != nil {
+			c.logger.Print("zoom login failed: ", err)
+			oauth.ErrorPage(w, "Zoom", err, r.URL.Path)
 			return
 		} else {
 			c.updateCreds(token)
@@ -276,6 +369,89 @@ func (c *Client) ListRecordings(ctx context.Context, since time.Time, nextPageTo
 	return &j, nil
 }
 
+// GetMeetingRecordings gets the recordings of a single meeting instance, by its UUID.
+// https://marketplace.zoom.us/docs/api-reference/zoom-api/cloud-recording/recordingget
+func (c *Client) GetMeetingRecordings(ctx context.Context, uuid string) (*Meeting, error) {
+	var j Meeting
+	req, err := c.NewApiRequest(ctx, http.MethodGet, "v2/meetings/"+EncodeUUID(uuid)+"/recordings")
+	if err != nil {
+		return nil, fmt.Errorf("while building GetMeetingRecordings request: %w", err)
+	}
+	if _, err := c.Do(req, &j); err != nil {
+		return nil, fmt.Errorf("while executing GetMeetingRecordings request: %w", err)
+	}
+	return &j, nil
+}
+
+// EncodeUUID escapes a meeting UUID for use in an API path.
+// UUIDs starting with / or containing // must be double encoded.
+// https://marketplace.zoom.us/docs/api-reference/using-zoom-apis#meeting-id-and-uuid
+func EncodeUUID(uuid string) string {
+	escaped := url.PathEscape(uuid)
+	if strings.HasPrefix(uuid, "/") || strings.Contains(uuid, "//") {
+		escaped = url.PathEscape(escaped)
+	}
+	return escaped
+}
+
+// https://marketplace.zoom.us/docs/api-reference/zoom-api/meetings/meetingregistrants
+func (c *Client) ListMeetingRegistrants(ctx context.Context, meetingID int64, nextPageToken string) (*ListRegistrantsResponse, error) {
+	var j ListRegistrantsResponse
+	req, err := c.NewApiRequest(ctx, http.MethodGet, fmt.Sprintf("v2/meetings/%d/registrants", meetingID))
+	if err != nil {
+		return nil, fmt.Errorf("while building ListMeetingRegistrants request: %w", err)
+	}
+	v := req.URL.Query()
+	v.Set("page_size", "300") // max
+	if nextPageToken != "" {
+		v.Set("next_page_token", nextPageToken)
+	}
+	req.URL.RawQuery = v.Encode()
+	if _, err := c.Do(req, &j); err != nil {
+		return nil, fmt.Errorf("while executing ListMeetingRegistrants request: %w", err)
+	}
+	return &j, nil
+}
+
+// https://marketplace.zoom.us/docs/api-reference/zoom-api/meetings/pastmeetingparticipants
+func (c *Client) ListPastMeetingParticipants(ctx context.Context, uuid string, nextPageToken string) (*ListParticipantsResponse, error) {
+	var j ListParticipantsResponse
+	req, err := c.NewApiRequest(ctx, http.MethodGet, "v2/past_meetings/"+EncodeUUID(uuid)+"/participants")
+	if err != nil {
+		return nil, fmt.Errorf("while building ListPastMeetingParticipants request: %w", err)
+	}
+	v := req.URL.Query()
+	v.Set("page_size", "300") // max
+	if nextPageToken != "" {
+		v.Set("next_page_token", nextPageToken)
+	}
+	req.URL.RawQuery = v.Encode()
+	if _, err := c.Do(req, &j); err != nil {
+		return nil, fmt.Errorf("while executing ListPastMeetingParticipants request: %w", err)
+	}
+	return &j, nil
+}
+
+// ListMeetingParticipantsReport requires a paid account and the report:read:admin scope.
+// https://marketplace.zoom.us/docs/api-reference/zoom-api/reports/reportmeetingparticipants
+func (c *Client) ListMeetingParticipantsReport(ctx context.Context, uuid string, nextPageToken string) (*ListParticipantsResponse, error) {
+	var j ListParticipantsResponse
+	req, err := c.NewApiRequest(ctx, http.MethodGet, "v2/report/meetings/"+EncodeUUID(uuid)+"/participants")
+	if err != nil {
+		return nil, fmt.Errorf("while building ListMeetingParticipantsReport request: %w", err)
+	}
+	v := req.URL.Query()
+	v.Set("page_size", "300") // max
+	if nextPageToken != "" {
+		v.Set("next_page_token", nextPageToken)
+	}
+	req.URL.RawQuery = v.Encode()
+	if _, err := c.Do(req, &j); err != nil {
+		return nil, fmt.Errorf("while executing ListMeetingParticipantsReport request: %w", err)
+	}
+	return &j, nil
+}
+
 func (c *Client) UpdateOauthRedirect(url string) {
 	c.config.RedirectURL = url
 }
@@ -2,9 +2,18 @@ package zoom
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
 )
 
 func TestNewClientFromReader(t *testing.T) {
@@ -69,3 +78,229 @@ func TestNewClientFromReader(t *testing.T) {
 		})
 	}
 }
+
+func TestEncodeUUID(t *testing.T) {
+	tests := []struct {
+		uuid string
+		want string
+	}{
+		{uuid: "4444AAAiAAAAAiAiAiiAii==", want: "4444AAAiAAAAAiAiAiiAii=="},
+		{uuid: "abc/def+ghi==", want: "abc%2Fdef+ghi=="},
+		{uuid: "/ajXp112QmuoKj4854875==", want: "%252FajXp112QmuoKj4854875=="},
+		{uuid: "ajXp112Qmuo//Kj4854875==", want: "ajXp112Qmuo%252F%252FKj4854875=="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.uuid, func(t *testing.T) {
+			if got := EncodeUUID(tt.uuid); got != tt.want {
+				t.Errorf("EncodeUUID() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewApiRequestEscapedPath(t *testing.T) {
+	var clog bytes.Buffer
+	c, err := NewClient(log.New(&clog, "", 0), Config{
+		Id:            "test-id",
+		Secret:        "test-secret",
+		OauthRedirect: "http://redirect",
+		ApiBaseUrl:    "http://zoom/api",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := c.NewApiRequest(context.Background(), http.MethodGet, "v2/past_meetings/"+EncodeUUID("/abc==")+"/participants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://zoom/api/v2/past_meetings/%252Fabc==/participants"; req.URL.String() != want {
+		t.Errorf("expected %s, got %s", want, req.URL.String())
+	}
+}
+
+func TestDownload(t *testing.T) {
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			t.Errorf("credentials forwarded off-domain: %s", auth)
+		}
+		w.Write([]byte("recording"))
+	}))
+	defer cdn.Close()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("access_token") != "" {
+			t.Error("access token sent as a query parameter")
+		}
+		switch r.Header.Get("Authorization") {
+		case "Bearer oauth-token", "Bearer webhook-token":
+		default:
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/protected" && r.URL.Query().Get("pwd") != "secret" {
+			http.Error(w, "passcode required", http.StatusForbidden)
+			return
+		}
+		http.Redirect(w, r, cdn.URL+"/file.mp4", http.StatusFound)
+	}))
+	defer api.Close()
+
+	var clog bytes.Buffer
+	c, err := NewClient(log.New(&clog, "", 0), Config{
+		Id:            "test-id",
+		Secret:        "test-secret",
+		OauthRedirect: "http://redirect",
+		ApiBaseUrl:    api.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.tokens.Set(&oauth2.Token{AccessToken: "oauth-token", Expiry: time.Now().Add(time.Hour)})
+
+	download := func(url string, options ...DownloadOption) (string, error) {
+		body, err := c.Download(context.Background(), RecordingFile{DownloadURL: url}, options...)
+		if err != nil {
+			return "", err
+		}
+		defer body.Close()
+		b, err := ioutil.ReadAll(body)
+		return string(b), err
+	}
+
+	if got, err := download(api.URL + "/file"); err != nil || got != "recording" {
+		t.Errorf("expected recording, got %q, %v", got, err)
+	}
+	if got, err := download(api.URL+"/file", WithDownloadAccessToken("webhook-token")); err != nil || got != "recording" {
+		t.Errorf("expected recording with download token, got %q, %v", got, err)
+	}
+	meeting := Meeting{RecordingPlayPasscode: "secret"}
+	if got, err := download(api.URL+"/protected", meeting.DownloadOptions()...); err != nil || got != "recording" {
+		t.Errorf("expected protected recording, got %q, %v", got, err)
+	}
+
+	_, err = download(api.URL+"/file?token=leaked", WithDownloadAccessToken("bad-token"))
+	if err == nil {
+		t.Fatal("expected error with rejected token")
+	}
+	for _, secret := range []string{"leaked", "bad-token", "oauth-token"} {
+		if strings.Contains(err.Error(), secret) {
+			t.Errorf("error exposes %q: %s", secret, err)
+		}
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	got := RedactURL("https://zoom.us/rec/download/abc?access_token=secret&pwd=pass&type=mp4")
+	if strings.Contains(got, "secret") || strings.Contains(got, "pass&") || !strings.Contains(got, "type=mp4") {
+		t.Errorf("credentials not redacted: %s", got)
+	}
+}
+
+func TestDoRetries(t *testing.T) {
+	var calls int
+	var responses []func(w http.ResponseWriter)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oauth/token" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token":"refreshed","refresh_token":"r","expires_in":3600}`))
+			return
+		}
+		responses[calls](w)
+		calls++
+	}))
+	defer srv.Close()
+
+	var clog bytes.Buffer
+	c, err := NewClient(log.New(&clog, "", 0), Config{
+		Id:            "test-id",
+		Secret:        "test-secret",
+		OauthRedirect: "http://redirect",
+		ApiBaseUrl:    srv.URL,
+		TokenUrl:      srv.URL + "/oauth/token",
+	}, RetryOption(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.tokens.Set(&oauth2.Token{AccessToken: "stale", RefreshToken: "r", Expiry: time.Now().Add(time.Hour)})
+
+	ok := func(w http.ResponseWriter) { w.Write([]byte(`{"page_size":300}`)) }
+	fail := func(status int, header map[string]string) func(w http.ResponseWriter) {
+		return func(w http.ResponseWriter) {
+			for k, v := range header {
+				w.Header().Set(k, v)
+			}
+			w.WriteHeader(status)
+			w.Write([]byte(`{"code":429,"message":"too many requests"}`))
+		}
+	}
+	list := func() error {
+		_, err := c.ListRecordings(context.Background(), time.Now(), "")
+		return err
+	}
+
+	tests := []struct {
+		name      string
+		responses []func(w http.ResponseWriter)
+		wantCalls int
+		wantErr   bool
+		wantIs    error
+	}{
+		{name: "qps", responses: []func(w http.ResponseWriter){
+			fail(http.StatusTooManyRequests, map[string]string{"X-RateLimit-Type": RateLimitQPS, "Retry-After": "0"}),
+			fail(http.StatusServiceUnavailable, nil),
+			ok,
+		}, wantCalls: 3},
+		{name: "exhausted", responses: []func(w http.ResponseWriter){
+			fail(http.StatusBadGateway, nil), fail(http.StatusBadGateway, nil), fail(http.StatusBadGateway, nil),
+		}, wantCalls: 3, wantErr: true},
+		{name: "daily", responses: []func(w http.ResponseWriter){
+			fail(http.StatusTooManyRequests, map[string]string{"X-RateLimit-Type": RateLimitDaily}),
+		}, wantCalls: 1, wantErr: true, wantIs: ErrRateLimited},
+		{name: "not found", responses: []func(w http.ResponseWriter){
+			fail(http.StatusNotFound, nil),
+		}, wantCalls: 1, wantErr: true, wantIs: ErrNotFound},
+		{name: "unauthorized", responses: []func(w http.ResponseWriter){
+			fail(http.StatusUnauthorized, nil), ok,
+		}, wantCalls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = 0
+			responses = tt.responses
+			err := list()
+			if calls != tt.wantCalls {
+				t.Errorf("expected %d calls, got %d", tt.wantCalls, calls)
+			}
+			var apiErr *APIError
+			switch {
+			case !tt.wantErr && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case !tt.wantErr:
+			case !errors.As(err, &apiErr):
+				t.Errorf("expected APIError, got %v", err)
+			case tt.wantIs != nil && !errors.Is(err, tt.wantIs):
+				t.Errorf("expected %v, got %v", tt.wantIs, err)
+			}
+		})
+	}
+	if token, _ := c.tokens.Token(); token.AccessToken != "refreshed" {
+		t.Errorf("expected refreshed token, got %s", token.AccessToken)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	rsp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+	rsp.Header.Set("X-RateLimit-Type", RateLimitQPS)
+	rsp.Header.Set("Retry-After", "3")
+	err := newAPIError("https://api.zoom.us/v2/users/me/recordings", rsp, []byte(`{"code":429,"message":"slow down"}`))
+	if err.Code != 429 || err.Message != "slow down" || err.RetryAfter != 3*time.Second || !err.Temporary() {
+		t.Errorf("unexpected error details: %#v", err)
+	}
+	if !errors.Is(err, ErrRateLimited) || errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected errors.Is matching for %s", err)
+	}
+
+	now := time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)
+	if d := parseRetryAfter("2020-04-01T00:00:10Z", now); d != 10*time.Second {
+		t.Errorf("expected 10s, got %s", d)
+	}
+}